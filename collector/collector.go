@@ -0,0 +1,1737 @@
+// Package collector implements a Prometheus collector for the metrics written
+// by the factorio-prometheus-exporter mod. It logs through the default slog
+// logger.
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects metrics from the Factorio JSON file written by the mod, or
+// from an event stream carrying the same documents. Its exported fields
+// configure what is collected and must not be changed once it is registered.
+type Collector struct {
+	// MetricsPath is the path of the metrics file, an http:// or https://
+	// URL it is served at, or an sse:// or sses:// URL of an event stream.
+	MetricsPath string
+	// MaxReadBytes limits the size of metrics data read from a URL, an event
+	// stream or a file that is not a regular file, such as a FIFO or
+	// /dev/stdin, after decompression.
+	MaxReadBytes int
+	// MinReadInterval serves scrapes within this time of the last collection
+	// from its metrics, instead of reading the metrics data again. Zero reads
+	// it on every scrape.
+	MinReadInterval time.Duration
+	// ReadTimeout bounds how long reading the metrics file or fetching it from
+	// a URL may take. Zero disables the timeout.
+	ReadTimeout time.Duration
+	// ServeLastData collects the metrics from the last successfully parsed
+	// metrics data when the current data cannot be parsed, such as a file
+	// caught half-written, instead of reporting only factorio_up.
+	ServeLastData bool
+
+	// ReportUnknownKeys reports top-level keys the collector does not consume.
+	ReportUnknownKeys bool
+	// CollectRecipes adds the number of machines per recipe.
+	CollectRecipes bool
+	// UnpoweredEntities adds the number of unpowered entities per prototype.
+	UnpoweredEntities bool
+	// LogisticRequests adds unfulfilled logistic requests per item.
+	LogisticRequests bool
+	// TrainNetworks adds a rail network label to train counts.
+	TrainNetworks bool
+	// PlayerInventory adds the items in the main inventory of each player.
+	PlayerInventory bool
+	// SurfaceClock adds the time of day of each surface as an hh:mm label.
+	SurfaceClock bool
+	// EntityQuality adds a quality label to entity counts.
+	EntityQuality bool
+	// EntityAggregation is "type" to sum entity counts per prototype type,
+	// as given by the metadata file, instead of reporting them per name.
+	EntityAggregation string
+	// EntityInclude, if set, limits entity counts to the prototypes whose name
+	// it matches. EntityExclude drops those whose name it matches. Either way,
+	// the surface totals and enemy counts include every entity.
+	EntityInclude *regexp.Regexp
+	EntityExclude *regexp.Regexp
+	// SurfaceInclude, if set, limits all metrics broken down by surface to the
+	// surfaces whose name it matches.
+	SurfaceInclude *regexp.Regexp
+	// DefaultForce is the force label of entity counts not grouped by force.
+	DefaultForce string
+	// MetadataPath is the path of an optional prototype metadata file.
+	MetadataPath string
+	// DisabledCollectors skips the collectors with the given names, as
+	// returned by CollectorNames.
+	DisabledCollectors map[string]bool
+
+	// Namespace replaces the factorio prefix of metric names.
+	Namespace string
+	// Exemplars attaches the current game tick to counters as an exemplar.
+	// OpenMetrics only allows exemplars on counters named *_total, so it
+	// should be combined with TotalSuffix.
+	Exemplars bool
+	// TotalSuffix appends _total to the names of counters without it, as
+	// OpenMetrics requires. Otherwise they are exposed with the unknown type
+	// in the OpenMetrics format.
+	TotalSuffix bool
+	// ZeroNonFinite emits NaN and infinite values as 0 instead of dropping them.
+	ZeroNonFinite bool
+	// LabelMap renames label values per label name.
+	LabelMap LabelMap
+	// NormalizeLabels lowercases and trims label values.
+	NormalizeLabels bool
+
+	// StaleTimeout is how long the metrics data may go without changing before
+	// OnStale is called. Only collections that read new data count: a file
+	// with the same modification time and size, an unchanged HTTP document or
+	// the same event does not, and neither does Healthy, so a collector that is
+	// not scraped goes stale as well. Zero disables the check.
+	StaleTimeout time.Duration
+	// OnStale is called once the metrics data is stale.
+	OnStale func()
+
+	stream        *sseStream
+	http          *httpSource
+	metadata      *metadataFile
+	watchdog      *time.Timer
+	watchedData   *metricsData
+	mutex         sync.RWMutex
+	collected     []prometheus.Metric
+	collectedAt   time.Time
+	data          *metricsData
+	evolution     map[string]rateSample
+	research      map[string]researchSample
+	launches      map[string]rateSample
+	lastLaunches  map[string]float64
+	ups           *rateSample
+	saveLoads     float64
+	schemaWarned  float64
+	counters      map[string]float64
+	counterResets map[string]float64
+	pausedSince   time.Time
+	scrapeErrors  float64
+	modTime       time.Time
+	dataModTime   time.Time
+	dataSize      int64
+	dataReceived  time.Time
+	pendingRead   chan fileRead
+}
+
+// NewFactorioCollector creates a collector reading the metrics file or event
+// stream at path, with the same defaults as the exporter's flags.
+func NewFactorioCollector(path string) *Collector {
+	return &Collector{
+		MetricsPath:  path,
+		MaxReadBytes: 64 << 20,
+		ReadTimeout:  5 * time.Second,
+		DefaultForce: "player",
+		Namespace:    "factorio",
+	}
+}
+
+// Start begins the background work of the collector until ctx is done: reading
+// an event stream source and watching for stale data. It must be called before
+// collecting from an event stream.
+func (c *Collector) Start(ctx context.Context) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if IsSSESource(c.MetricsPath) {
+		c.stream = newSSEStream(c.MetricsPath, c.MaxReadBytes)
+		go c.stream.run(ctx)
+	}
+	if c.StaleTimeout > 0 && c.OnStale != nil {
+		c.watchdog = time.AfterFunc(c.StaleTimeout, c.OnStale)
+		context.AfterFunc(ctx, func() { c.watchdog.Stop() })
+	}
+}
+
+// WaitReady blocks until an event stream source has received its first event
+// or ctx is done, so that a single collection right after Start does not find
+// the stream still connecting. It returns immediately for other sources.
+func (c *Collector) WaitReady(ctx context.Context) error {
+	c.mutex.RLock()
+	stream := c.stream
+	c.mutex.RUnlock()
+	if stream == nil {
+		return nil
+	}
+	return stream.wait(ctx)
+}
+
+// rateSample is a value observed at a game tick, along with its rate of change
+// per tick since the previous sample.
+type rateSample struct {
+	tick    float64
+	value   float64
+	rate    float64
+	hasRate bool
+}
+
+// next returns the sample following s for a value observed at tick. A rate is
+// only available once two samples with different ticks have been seen. If the
+// tick or the value goes backwards, a new game or an older save was loaded, so
+// the previous sample is discarded. If the tick has not advanced, s is kept.
+func (s rateSample) next(ok bool, tick, value float64) rateSample {
+	switch {
+	case !ok || tick < s.tick || value < s.value:
+		return rateSample{tick: tick, value: value}
+	case tick > s.tick:
+		return rateSample{
+			tick:    tick,
+			value:   value,
+			rate:    (value - s.value) / (tick - s.tick),
+			hasRate: true,
+		}
+	}
+	return s
+}
+
+// ticksPerSecond is the number of game ticks in a second of game time.
+const ticksPerSecond = 60
+
+// ticksPerMinute is the number of game ticks in a minute of game time.
+const ticksPerMinute = 60 * ticksPerSecond
+
+// collectors are the collect methods run on every collection, along with the
+// name they are disabled by.
+var collectors = []struct {
+	name    string
+	collect func(*Collector, *metricSet)
+}{
+	{"time", (*Collector).collectTimeMetrics},
+	{"players", (*Collector).collectPlayerStateMetrics},
+	{"forces", (*Collector).collectForceMetrics},
+	{"pollution", (*Collector).collectPollutionMetrics},
+	{"surfaces", (*Collector).collectSurfaceMetrics},
+	{"entities", (*Collector).collectEntityMetrics},
+	{"entity_status", (*Collector).collectEntityStatusMetrics},
+	{"rockets", (*Collector).collectRocketMetrics},
+	{"trains", (*Collector).collectTrainMetrics},
+	{"electricity", (*Collector).collectElectricityMetrics},
+	{"circuits", (*Collector).collectCircuitMetrics},
+	{"logistic_requests", (*Collector).collectLogisticRequestMetrics},
+	{"logistic_networks", (*Collector).collectLogisticMetrics},
+}
+
+// labelNames are the names of the labels of the collector's metrics.
+var labelNames = []string{
+	"category", "collector", "display_name", "force", "hhmm", "item", "metric",
+	"name", "network", "network_id", "pack", "pollutant", "prototype", "quality",
+	"recipe", "resource", "signal_name", "signal_type", "source", "stack_size",
+	"state", "surface", "technology", "type", "username", "victim_type",
+}
+
+// LabelNames returns the names of the labels the collector's metrics may
+// carry, which constant labels added to them must not reuse.
+func LabelNames() []string {
+	return append([]string(nil), labelNames...)
+}
+
+// CollectorNames returns the names of the collectors that can be disabled
+// through DisabledCollectors, in the order they run.
+func CollectorNames() []string {
+	names := make([]string, len(collectors))
+	for i, collector := range collectors {
+		names[i] = collector.name
+	}
+	return names
+}
+
+// railSignalStates are the rail signal states reported as-is. Any other state
+// is counted as "other" to bound cardinality.
+var railSignalStates = map[string]bool{
+	"open":                        true,
+	"closed":                      true,
+	"reserved":                    true,
+	"reserved_by_circuit_network": true,
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if c.MinReadInterval > 0 {
+		c.collectCached(ch)
+		return
+	}
+	// Lock the mutex to prevent data races.
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.collect(ch)
+}
+
+// collectCached serves the metrics of the previous collection if it is more
+// recent than MinReadInterval. Concurrent scrapes share the read lock, so they
+// do not wait for each other, and only a new collection takes the write lock.
+func (c *Collector) collectCached(ch chan<- prometheus.Metric) {
+	c.mutex.RLock()
+	if time.Since(c.collectedAt) < c.MinReadInterval {
+		for _, metric := range c.collected {
+			ch <- metric
+		}
+		c.mutex.RUnlock()
+		return
+	}
+	c.mutex.RUnlock()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	// Another scrape may have collected while this one waited for the lock.
+	if time.Since(c.collectedAt) >= c.MinReadInterval {
+		metrics := make(chan prometheus.Metric)
+		go func() {
+			c.collect(metrics)
+			close(metrics)
+		}()
+		c.collected = c.collected[:0]
+		for metric := range metrics {
+			c.collected = append(c.collected, metric)
+		}
+		c.collectedAt = time.Now()
+	}
+	for _, metric := range c.collected {
+		ch <- metric
+	}
+}
+
+// collect reads the metrics data and sends the metrics to ch. The caller must
+// hold the write lock.
+func (c *Collector) collect(ch chan<- prometheus.Metric) {
+	slog.Debug("Collecting metrics")
+	start := time.Now()
+
+	// Read the metrics data from the JSON file.
+	err := c.readMetricsData()
+	stale := false
+	if err != nil {
+		slog.Error("Error reading metrics data", "error", err)
+		c.scrapeErrors++
+		var parseErr *parseError
+		if !c.ServeLastData || c.data == nil || !errors.As(err, &parseErr) {
+			c.collectScrapeMetrics(ch, false)
+			return
+		}
+		stale = true
+	}
+	if c.watchdog != nil && !stale && c.data != c.watchedData {
+		c.watchdog.Reset(c.StaleTimeout)
+		c.watchedData = c.data
+	}
+
+	if c.SurfaceInclude != nil {
+		c.data.keepSurfaces(c.surfaceIncluded)
+	}
+
+	if c.MetadataPath != "" && c.metadata == nil {
+		c.metadata = &metadataFile{path: c.MetadataPath}
+	}
+
+	metrics := c.newMetricSet()
+	c.collectSchemaMetrics(metrics)
+	durations := map[string]time.Duration{}
+	run := func(name string, collect func(*Collector, *metricSet)) {
+		collectStart := time.Now()
+		collect(c, metrics)
+		durations[name] = time.Since(collectStart)
+	}
+	for _, collector := range collectors {
+		if !c.DisabledCollectors[collector.name] {
+			run(collector.name, collector.collect)
+		}
+	}
+	if c.CollectRecipes {
+		run("recipes", (*Collector).collectRecipeMetrics)
+	}
+	if c.MetadataPath != "" {
+		run("prototype_info", (*Collector).collectPrototypeInfoMetrics)
+	}
+	if c.ReportUnknownKeys {
+		run("unknown_keys", (*Collector).collectUnknownKeyMetrics)
+	}
+	samples := metrics.emit(ch)
+	c.collectScrapeMetrics(ch, !stale)
+	if c.ServeLastData {
+		staleValue := 0.0
+		if stale {
+			staleValue = 1
+		}
+		ch <- prometheus.MustNewConstMetric(c.newDesc("factorio_metrics_data_stale", "Whether the metrics are from earlier data because the current data could not be parsed (boolean)."),
+			prometheus.GaugeValue, staleValue)
+	}
+	c.collectDurationMetrics(ch, durations, samples, time.Since(start))
+
+	slog.Debug("Collected metrics", "samples", samples)
+}
+
+// collectSchemaMetrics reports whether the metrics data has a different schema
+// version than the collector is built for, in which case renamed fields may be
+// missing from the metrics. The warning is logged once per version seen.
+func (c *Collector) collectSchemaMetrics(metrics *metricSet) {
+	version := c.data.SchemaVersion
+	if version == nil {
+		return
+	}
+	mismatch := 0.0
+	if *version != SchemaVersion {
+		mismatch = 1
+		if c.schemaWarned != *version {
+			slog.Warn("Unexpected schema version of the metrics data, metrics may be missing or zero", "schema_version", *version, "expected", SchemaVersion)
+			c.schemaWarned = *version
+		}
+	}
+	metrics.nonAdditiveGauge("factorio_metrics_schema_mismatch", "Whether the schema version of the metrics data differs from the one the exporter is built for (boolean).",
+		mismatch,
+	)
+}
+
+// collectDurationMetrics emits the time spent collecting and the number of
+// samples collected, to tell which collectors make scrapes slow.
+func (c *Collector) collectDurationMetrics(ch chan<- prometheus.Metric, durations map[string]time.Duration, samples int, total time.Duration) {
+	desc := prometheus.NewDesc(MetricName(c.Namespace, "factorio_exporter_collector_duration_seconds"), "The time a collector took during the last collection (seconds).", []string{"collector"}, nil)
+	for name, duration := range durations {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, duration.Seconds(), name)
+	}
+	ch <- prometheus.MustNewConstMetric(c.newDesc("factorio_exporter_collect_duration_seconds", "The time the last collection took, including reading the metrics data (seconds)."),
+		prometheus.GaugeValue, total.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.newDesc("factorio_exporter_collected_samples_total", "The number of samples emitted by the last collection (count)."),
+		prometheus.GaugeValue, float64(samples))
+}
+
+// collectScrapeMetrics emits the outcome of reading the metrics data. These
+// metrics are sent even when the read fails, so they bypass the metric set.
+func (c *Collector) collectScrapeMetrics(ch chan<- prometheus.Metric, up bool) {
+	upValue := 0.0
+	if up {
+		upValue = 1
+	}
+	ch <- prometheus.MustNewConstMetric(c.newDesc("factorio_up", "Whether the last read of the metrics data succeeded (boolean)."),
+		prometheus.GaugeValue, upValue)
+	ch <- prometheus.MustNewConstMetric(c.newDesc("factorio_exporter_scrape_errors_total", "The number of failed reads of the metrics data (count)."),
+		prometheus.CounterValue, c.scrapeErrors)
+	if !c.modTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.newDesc("factorio_metrics_file_age_seconds", "The time since the metrics file was last modified (seconds)."),
+			prometheus.GaugeValue, time.Since(c.modTime).Seconds())
+		ch <- prometheus.MustNewConstMetric(c.newDesc("factorio_metrics_file_mtime_seconds", "The modification time of the metrics file as a unix timestamp (seconds)."),
+			prometheus.GaugeValue, float64(c.modTime.UnixNano())/1e9)
+	}
+}
+
+// newDesc creates the description of a metric without labels, with its name
+// in the collector's namespace.
+func (c *Collector) newDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(MetricName(c.Namespace, name), help, nil, nil)
+}
+
+// MetricName returns name, which is written with the factorio prefix, in the
+// given namespace. An empty namespace keeps the factorio prefix.
+func MetricName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + strings.TrimPrefix(name, "factorio")
+}
+
+func (c *Collector) collectTimeMetrics(metrics *metricSet) {
+	metrics.counter("factorio_game_tick", "The current tick of the running Factorio game (ticks).",
+		c.data.tick(),
+	)
+
+	pausedInt := 0
+	if c.data.Game.Time.Paused {
+		pausedInt = 1
+	}
+
+	metrics.nonAdditiveGauge("factorio_game_paused", "The current pause state of the running Factorio game (boolean).",
+		float64(pausedInt),
+	)
+
+	// The pause duration is measured from the first scrape that saw the game
+	// paused, so it restarts from zero when the exporter restarts.
+	pauseDuration := 0.0
+	if pausedInt == 1 {
+		if c.pausedSince.IsZero() {
+			c.pausedSince = time.Now()
+		}
+		pauseDuration = time.Since(c.pausedSince).Seconds()
+	} else {
+		c.pausedSince = time.Time{}
+	}
+	metrics.nonAdditiveGauge("factorio_game_pause_duration_seconds", "The time the game has been paused for, 0 while it is running (seconds).",
+		pauseDuration,
+	)
+
+	c.collectSaveLoadMetrics(metrics)
+	c.collectUPSMetrics(metrics)
+}
+
+// collectUPSMetrics emits the updates per second reported by the mod, and an
+// estimate from the ticks that passed between two versions of the metrics
+// data. The data is timed by the modification time of the file if known, or
+// else by when it was received, and sampled like other rates with the time in
+// seconds in place of the tick. A version is only sampled once the tick has
+// changed, so that data sent again unchanged does not pull the estimate to
+// zero and inflate the next one.
+func (c *Collector) collectUPSMetrics(metrics *metricSet) {
+	if ups := c.data.Game.UPS; ups != nil {
+		metrics.nonAdditiveGauge("factorio_game_ups", "The game updates per second reported by the mod (updates per second).",
+			*ups,
+		)
+	}
+
+	observed := c.modTime
+	if observed.IsZero() {
+		observed = c.dataReceived
+	}
+	var sample rateSample
+	if c.ups != nil {
+		sample = *c.ups
+	}
+	if c.ups == nil || c.data.tick() != sample.value {
+		sample = sample.next(c.ups != nil, float64(observed.UnixNano())/1e9, c.data.tick())
+		c.ups = &sample
+	}
+	if sample.hasRate {
+		metrics.nonAdditiveGauge("factorio_game_ups_estimated", "The game updates per second estimated from the progress of the game tick (updates per second).",
+			sample.rate,
+		)
+	}
+}
+
+// collectSaveLoadMetrics emits the number of times the save was loaded. When
+// it changes, the save was reloaded and the values the rates are derived from
+// are no longer comparable, so the rate samples are discarded.
+func (c *Collector) collectSaveLoadMetrics(metrics *metricSet) {
+	loads := c.data.Game.SaveLoadCount
+	if loads == nil {
+		return
+	}
+	if count := *loads; count != c.saveLoads {
+		if c.saveLoads != 0 {
+			slog.Info("Save was reloaded, resetting rates", "save_load_count", count)
+			c.evolution = nil
+			c.research = nil
+			c.launches = nil
+			c.lastLaunches = nil
+			c.ups = nil
+		}
+		c.saveLoads = count
+	}
+	metrics.counter("factorio_save_load_count", "The number of times the save has been loaded (count).",
+		*loads,
+	)
+}
+
+func (c *Collector) collectPlayerStateMetrics(metrics *metricSet) {
+	// The connected players add to the count, so that it is zero rather than
+	// missing while nobody is online.
+	metrics.gauge("factorio_players_online", "The number of connected players (count).", 0)
+	for username, player := range c.data.Players {
+		connectedValue := 0.0
+		if player.Connected {
+			connectedValue = 1.0
+		}
+		metrics.nonAdditiveGauge("factorio_player_connected", "The current connection state of the player (boolean).",
+			connectedValue,
+			"username", username,
+		)
+		metrics.gauge("factorio_players_online", "The number of connected players (count).", connectedValue)
+		if online := player.OnlineTime; online != nil {
+			metrics.counter("factorio_player_online_time_seconds", "The total game time the player has been connected for (seconds).",
+				*online/ticksPerSecond,
+				"username", username,
+			)
+		}
+		if afk := player.AfkTime; afk != nil {
+			metrics.nonAdditiveGauge("factorio_player_afk_time_seconds", "The game time since the player was last active (seconds).",
+				*afk/ticksPerSecond,
+				"username", username,
+			)
+		}
+		if player.Surface != "" && c.surfaceIncluded(player.Surface) {
+			metrics.nonAdditiveGauge("factorio_player_surface", "The surface a player is on, always 1 (info).",
+				1,
+				"surface", player.Surface,
+				"username", username,
+			)
+		}
+		// The position of a disconnected player is where they left, so it is
+		// only reported while they are connected.
+		if position := player.Position; position != nil && player.Connected {
+			metrics.nonAdditiveGauge("factorio_player_position_x", "The x coordinate of a connected player (tiles).",
+				position.X,
+				"username", username,
+			)
+			metrics.nonAdditiveGauge("factorio_player_position_y", "The y coordinate of a connected player (tiles).",
+				position.Y,
+				"username", username,
+			)
+		}
+		if !c.PlayerInventory {
+			continue
+		}
+		for item_name, count := range player.Inventory {
+			metrics.gauge("factorio_player_inventory_item_count", "The number of items of a given kind in the main inventory of a player (items).",
+				count,
+				"item", item_name,
+				"username", username,
+			)
+		}
+	}
+}
+
+func (c *Collector) collectForceMetrics(metrics *metricSet) {
+	for force_name, force := range c.data.Forces {
+		metrics.nonAdditiveGauge("factorio_force_research_progress", "The current research progress for a force (ratio, 0-1).",
+			force.Research.Progress,
+			"force", force_name,
+		)
+		if queue := force.Research.Queue; queue != nil {
+			metrics.gauge("factorio_force_research_queue_length", "The number of technologies in the research queue of a force (count).",
+				float64(len(queue)),
+				"force", force_name,
+			)
+		}
+		if technology := force.Research.Current; technology != "" {
+			metrics.nonAdditiveGauge("factorio_force_current_research", "The technology currently researched by a force, always 1 (info).",
+				1,
+				"force", force_name,
+				"technology", technology,
+			)
+		}
+		for pack, rate := range force.Research.SciencePerMinute {
+			metrics.gauge("factorio_force_science_per_minute", "The rate the labs of a force consume science packs at (packs per minute).",
+				rate,
+				"force", force_name,
+				"pack", pack,
+			)
+		}
+		c.collectResearchRate(metrics, force_name, force.Research.Current, force.Research.Progress)
+
+		c.collectEvolutionFactor(metrics, force_name, force.EvolutionFactor)
+		c.collectEvolutionRate(metrics, force_name, force.EvolutionFactor)
+
+		if pollution := force.PollutionProduced; pollution != nil {
+			metrics.counter("factorio_force_pollution_produced_total", "The total pollution produced by the entities of a force (pollution units).",
+				*pollution,
+				"force", force_name,
+			)
+		}
+
+		if manual := force.Crafts.Manual; manual != nil {
+			metrics.counter("factorio_force_manual_crafts_total", "The total number of items crafted by hand for a force (items).",
+				*manual,
+				"force", force_name,
+			)
+		}
+		if machine := force.Crafts.Machine; machine != nil {
+			metrics.counter("factorio_force_machine_crafts_total", "The total number of items crafted by machines for a force (items).",
+				*machine,
+				"force", force_name,
+			)
+		}
+
+		for victim_type, kills := range force.Kills {
+			metrics.counter("factorio_force_kills_total", "The total number of entities killed by a force (count).",
+				kills,
+				"force", force_name,
+				"victim_type", victim_type,
+			)
+		}
+		if deaths := force.Deaths; deaths != nil {
+			metrics.counter("factorio_force_deaths_total", "The total number of entities of a force that were killed (count).",
+				*deaths,
+				"force", force_name,
+			)
+		}
+
+		// Prototypes are keyed by type and name, so a prototype produced on
+		// several surfaces is only counted once.
+		activePrototypes := map[string]bool{}
+		collectPrototypeFlows(metrics, force_name, "items", force.Items, activePrototypes)
+		collectPrototypeFlows(metrics, force_name, "fluids", force.Fluids, activePrototypes)
+
+		metrics.gauge("factorio_force_active_prototypes_total", "The number of distinct item and fluid prototypes with nonzero production for a force (count).",
+			float64(len(activePrototypes)),
+			"force", force_name,
+		)
+	}
+}
+
+// collectPrototypeFlows emits the production and consumption of the items or
+// fluids of a force per surface, and records the prototypes with nonzero
+// production in active.
+func collectPrototypeFlows(metrics *metricSet, force_name, prototype_type string, surfaces map[string]map[string]flowData, active map[string]bool) {
+	for surface_name, prototypes := range surfaces {
+		for prototype_name, flow := range prototypes {
+			if production := flow.Production; production != nil {
+				if *production > 0 {
+					active[prototype_type+"/"+prototype_name] = true
+				}
+				metrics.counter("factorio_force_prototype_production", "The total production of a given prototype for a force, including zero; prototypes without a recorded value are omitted (items or fluid units).",
+					*production,
+					"force", force_name,
+					"prototype", prototype_name,
+					"surface", surface_name,
+					"type", prototype_type,
+				)
+			}
+			if consumption := flow.Consumption; consumption != nil {
+				metrics.counter("factorio_force_prototype_consumption", "The total consumption of a given prototype for a force, including zero; prototypes without a recorded value are omitted (items or fluid units).",
+					*consumption,
+					"force", force_name,
+					"prototype", prototype_name,
+					"surface", surface_name,
+					"type", prototype_type,
+				)
+			}
+		}
+	}
+}
+
+// collectEvolutionFactor emits the evolution factor of a force. With Space Age
+// the factor is an object with one value per surface. A single factor for the
+// whole force gets an empty surface, so that both forms share one label set.
+func (c *Collector) collectEvolutionFactor(metrics *metricSet, force_name string, evolution jsoniter.Any) {
+	factors := map[string]float64{}
+	switch valueType(evolution) {
+	case jsoniter.NumberValue:
+		factors[""] = evolution.ToFloat64()
+	case jsoniter.ObjectValue:
+		for _, surface_name := range evolution.Keys() {
+			factors[surface_name] = evolution.Get(surface_name).ToFloat64()
+		}
+	}
+	for surface_name, factor := range factors {
+		if surface_name != "" && !c.surfaceIncluded(surface_name) {
+			continue
+		}
+		metrics.nonAdditiveGauge("factorio_force_evolution_factor", "The evolution factor of a force (ratio, 0-1).",
+			factor,
+			"force", force_name,
+			"surface", surface_name,
+		)
+	}
+}
+
+// surfaceIncluded reports whether metrics of the named surface are collected.
+func (c *Collector) surfaceIncluded(surface_name string) bool {
+	return c.SurfaceInclude == nil || c.SurfaceInclude.MatchString(surface_name)
+}
+
+// collectEvolutionRate emits the change of a force's evolution factor per game
+// tick since the previous sample. The rate is omitted until two samples exist
+// and restarts when a new game or an older save is loaded.
+func (c *Collector) collectEvolutionRate(metrics *metricSet, force_name string, evolution jsoniter.Any) {
+	if valueType(evolution) != jsoniter.NumberValue {
+		return
+	}
+	if c.evolution == nil {
+		c.evolution = make(map[string]rateSample)
+	}
+	sample, ok := c.evolution[force_name]
+	sample = sample.next(ok, c.data.tick(), evolution.ToFloat64())
+	c.evolution[force_name] = sample
+
+	if sample.hasRate {
+		metrics.nonAdditiveGauge("factorio_force_evolution_rate", "The change of the evolution factor for a force (ratio per tick).",
+			sample.rate,
+			"force", force_name,
+		)
+	}
+}
+
+// clockTime formats a surface's daytime, where 0 is noon, as the hh:mm of a
+// 24-hour clock. The clock runs through a whole day whatever the length of the
+// surface's day in ticks.
+func clockTime(daytime float64) string {
+	day := daytime + 0.5
+	minutes := int(math.Floor((day-math.Floor(day))*24*60)) % (24 * 60)
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// researchSample is the research progress of a force for the technology it
+// was observed for.
+type researchSample struct {
+	technology string
+	rateSample
+}
+
+// collectResearchRate emits the change of a force's research progress per
+// minute of game time, which tells whether the labs are fed even if the mod
+// does not report the science consumption. The rate restarts with every
+// technology, as the progress is per technology.
+func (c *Collector) collectResearchRate(metrics *metricSet, force_name, technology string, progress float64) {
+	if technology == "" {
+		delete(c.research, force_name)
+		return
+	}
+	if c.research == nil {
+		c.research = make(map[string]researchSample)
+	}
+	sample, ok := c.research[force_name]
+	ok = ok && sample.technology == technology
+	sample = researchSample{technology, sample.next(ok, c.data.tick(), progress)}
+	c.research[force_name] = sample
+
+	if sample.hasRate {
+		metrics.nonAdditiveGauge("factorio_force_research_progress_rate", "The change of the research progress for a force (ratio per minute).",
+			sample.rate*ticksPerMinute,
+			"force", force_name,
+		)
+	}
+}
+
+// valueType returns the type of an optional value, which is nil if the
+// document does not contain it.
+func valueType(value jsoniter.Any) jsoniter.ValueType {
+	if value == nil {
+		return jsoniter.InvalidValue
+	}
+	return value.ValueType()
+}
+
+// collectPollutionMetrics emits the pollution of every source per surface. A
+// source is either a net amount or an object with separate production and
+// consumption amounts, which are reported as their difference. The emitted
+// and absorbed amounts are reported separately as well: a net amount is
+// emission if positive and absorption, such as by trees and tiles, if negative.
+// Either form may be given per pollutant, see forEachPollutant.
+func (c *Collector) collectPollutionMetrics(metrics *metricSet) {
+	for surface_name, sources := range c.data.Pollution {
+		for entity_name, source := range sources {
+			forEachPollutant(source, func(pollutant string, source jsoniter.Any) {
+				collectPollutionSource(metrics, surface_name, entity_name, pollutant, source)
+			})
+		}
+	}
+}
+
+func collectPollutionSource(metrics *metricSet, surface_name, entity_name, pollutant string, source jsoniter.Any) {
+	value := source.ToFloat64()
+	emitted, absorbed := math.Max(value, 0), math.Max(-value, 0)
+	split := source.ValueType() == jsoniter.ObjectValue
+	if split {
+		emitted = source.Get("production").ToFloat64()
+		absorbed = source.Get("consumption").ToFloat64()
+		value = emitted - absorbed
+	}
+	metrics.gauge("factorio_surface_pollution_production", "The pollution produced or consumed from various sources (pollution units).",
+		value,
+		"pollutant", pollutant,
+		"source", entity_name,
+		"surface", surface_name,
+	)
+	if emitted > 0 || split {
+		metrics.gauge("factorio_surface_pollution_emitted", "The pollution emitted by a source (pollution units).",
+			emitted,
+			"pollutant", pollutant,
+			"source", entity_name,
+			"surface", surface_name,
+		)
+	}
+	if absorbed > 0 || split {
+		metrics.gauge("factorio_surface_pollution_absorbed", "The pollution absorbed by a source, as a positive amount (pollution units).",
+			absorbed,
+			"pollutant", pollutant,
+			"source", entity_name,
+			"surface", surface_name,
+		)
+	}
+}
+
+// forEachPollutant calls fn with the amount of every pollutant in value. With
+// Space Age, surfaces have different pollutants, such as spores on Gleba, and
+// amounts may be objects keyed by pollutant. Any other value, including a
+// production and consumption object, is reported as the "pollution"
+// pollutant, which is the only one before Space Age.
+func forEachPollutant(value jsoniter.Any, fn func(pollutant string, amount jsoniter.Any)) {
+	if valueType(value) != jsoniter.ObjectValue || valueType(value.Get("production")) != jsoniter.InvalidValue || valueType(value.Get("consumption")) != jsoniter.InvalidValue {
+		fn("pollution", value)
+		return
+	}
+	for _, pollutant := range value.Keys() {
+		fn(pollutant, value.Get(pollutant))
+	}
+}
+
+func (c *Collector) collectSurfaceMetrics(metrics *metricSet) {
+	for surface_name, surface := range c.data.Surfaces {
+		forEachPollutant(surface.Pollution, func(pollutant string, amount jsoniter.Any) {
+			total := 0.0
+			if amount != nil {
+				total = amount.ToFloat64()
+			}
+			metrics.gauge("factorio_surface_pollution_total", "The total pollution on a given surface (pollution units).",
+				total,
+				"pollutant", pollutant,
+				"surface", surface_name,
+			)
+		})
+		metrics.nonAdditiveGauge("factorio_surface_ticks_per_day", "The length of a day on a given surface (ticks).",
+			surface.TicksPerDay,
+			"surface", surface_name,
+		)
+		if daytime := surface.Daytime; daytime != nil {
+			metrics.nonAdditiveGauge("factorio_surface_daytime", "The time of day on a given surface, where 0 is noon and 0.5 is midnight (fraction of a day).",
+				*daytime,
+				"surface", surface_name,
+			)
+			if c.SurfaceClock {
+				metrics.nonAdditiveGauge("factorio_surface_clock_info", "The time of day on a given surface as a 24-hour clock, always 1 (info).",
+					1,
+					"hhmm", clockTime(*daytime),
+					"surface", surface_name,
+				)
+			}
+		}
+		if darkness := surface.Darkness; darkness != nil {
+			metrics.nonAdditiveGauge("factorio_surface_darkness", "The darkness on a given surface, from 0 in full daylight to 1 (ratio).",
+				*darkness,
+				"surface", surface_name,
+			)
+		}
+		for force_name, count := range surface.Radars {
+			metrics.gauge("factorio_radars_total", "The number of radars on a given surface (count).",
+				count,
+				"force", force_name,
+				"surface", surface_name,
+			)
+		}
+		for force_name, count := range surface.Artillery {
+			metrics.gauge("factorio_artillery_total", "The number of artillery turrets and wagons on a given surface (count).",
+				count,
+				"force", force_name,
+				"surface", surface_name,
+			)
+		}
+		if cost := surface.UpdateCostMs; cost != nil {
+			metrics.gauge("factorio_surface_update_cost_ms", "The time spent updating entities on a given surface per tick (milliseconds).",
+				*cost,
+				"surface", surface_name,
+			)
+		}
+		if groups := surface.EnemyGroups; groups != nil {
+			metrics.gauge("factorio_surface_enemy_groups_total", "The number of enemy unit groups on a given surface (count).",
+				*groups,
+				"surface", surface_name,
+			)
+		}
+		if chunks := surface.EnemyChunks; chunks != nil {
+			metrics.gauge("factorio_surface_enemy_chunks_total", "The number of charted chunks containing enemy structures on a given surface (chunks).",
+				*chunks,
+				"surface", surface_name,
+			)
+		}
+		if generated := surface.Chunks.Generated; generated != nil {
+			metrics.gauge("factorio_surface_chunks_generated", "The number of generated chunks on a given surface (chunks).",
+				*generated,
+				"surface", surface_name,
+			)
+		}
+		if charted := surface.Chunks.Charted; charted != nil {
+			metrics.gauge("factorio_surface_chunks_charted", "The number of chunks charted by any force on a given surface (chunks).",
+				*charted,
+				"surface", surface_name,
+			)
+		}
+		if nextAttack := surface.NextAttackEstimateTicks; nextAttack != nil {
+			metrics.nonAdditiveGauge("factorio_surface_next_attack_estimate_ticks", "The estimated time until the next enemy attack on a given surface (ticks).",
+				*nextAttack,
+				"surface", surface_name,
+			)
+		}
+		if lamps := surface.Lamps.On; lamps != nil {
+			metrics.gauge("factorio_lamps_on_total", "The number of lamps that are currently on for a given surface (count).",
+				*lamps,
+				"surface", surface_name,
+			)
+		}
+		for state, count := range surface.RailSignals {
+			label := state
+			if !railSignalStates[state] {
+				label = "other"
+			}
+			metrics.gauge("factorio_rail_signals_total", "The number of rail signals in a given state for a given surface (count).",
+				count,
+				"state", label,
+				"surface", surface_name,
+			)
+		}
+		for resource_name, amount := range surface.Resources {
+			metrics.gauge("factorio_resource_amount", "The remaining amount of a resource on a given surface (resource units).",
+				amount,
+				"resource", resource_name,
+				"surface", surface_name,
+			)
+		}
+	}
+}
+
+// collectEntityMetrics emits the entity counts of every surface. Entities are
+// grouped by force, as in entities.<force>.<entity>. The older flat shape
+// entities.<entity> is attributed to the default force. Without the quality
+// label, the counts of all qualities of an entity are summed. When aggregating
+// by type, the counts of all entities of a prototype type are summed, and
+// entities missing from the metadata file are counted as the "unknown" type.
+func (c *Collector) collectEntityMetrics(metrics *metricSet) {
+	var prototypes map[string]prototypeMetadata
+	if c.EntityAggregation == "type" && c.metadata != nil {
+		var err error
+		prototypes, err = c.metadata.load()
+		if err != nil {
+			slog.Error("Error loading prototype metadata", "error", err)
+		}
+	}
+	forces := c.knownForces()
+	for surface_name, surface := range c.data.Surfaces {
+		// The entity counts below add to the total, so that a surface without
+		// entities still reports zero.
+		metrics.gauge("factorio_surface_entity_total", "The number of entities on a surface across all prototypes and forces (count).",
+			0,
+			"surface", surface_name,
+		)
+		for key, value := range surface.Entities {
+			// Lua serializes an empty table as an array, so that is a force
+			// without entities rather than an entity count.
+			if value.ValueType() == jsoniter.ArrayValue {
+				continue
+			}
+			if !isForceEntities(key, value, forces) {
+				c.collectEntityCount(metrics, prototypes, surface_name, c.DefaultForce, key, value)
+				continue
+			}
+			for _, entity_name := range value.Keys() {
+				c.collectEntityCount(metrics, prototypes, surface_name, key, entity_name, value.Get(entity_name))
+			}
+		}
+	}
+}
+
+func (c *Collector) collectEntityCount(metrics *metricSet, prototypes map[string]prototypeMetadata, surface_name, force_name, entity_name string, entity jsoniter.Any) {
+	byType := c.EntityAggregation == "type"
+	entity_type := prototypes[entity_name].Type
+	if entity_type == "" {
+		entity_type = "unknown"
+	}
+	filtered := c.EntityInclude != nil && !c.EntityInclude.MatchString(entity_name) ||
+		c.EntityExclude != nil && c.EntityExclude.MatchString(entity_name)
+	forEachQuality(entity, func(quality string, count float64) {
+		metrics.gauge("factorio_surface_entity_total", "The number of entities on a surface across all prototypes and forces (count).",
+			count,
+			"surface", surface_name,
+		)
+		if force_name == "enemy" {
+			metrics.gauge("factorio_enemy_entity_count", "The number of enemy entities, such as spawners, worms and units (count).",
+				count,
+				"name", entity_name,
+				"surface", surface_name,
+			)
+		}
+		if filtered {
+			return
+		}
+		labels := []string{"force", force_name}
+		if !byType {
+			labels = append(labels, "name", entity_name)
+		}
+		if c.EntityQuality {
+			labels = append(labels, "quality", quality)
+		}
+		labels = append(labels, "surface", surface_name)
+		if byType {
+			labels = append(labels, "type", entity_type)
+		}
+		metrics.gauge("factorio_entity_count", "The total number of entities (count).", count, labels...)
+	})
+}
+
+// knownForces returns the names of the forces in the JSON along with the
+// forces every game has.
+func (c *Collector) knownForces() map[string]bool {
+	forces := map[string]bool{"player": true, "enemy": true, "neutral": true}
+	for force_name := range c.data.Forces {
+		forces[force_name] = true
+	}
+	return forces
+}
+
+// isForceEntities reports whether an entry of a surface's entities is a force
+// holding entity counts rather than the count of a single entity. Per-quality
+// entity counts are objects as well, so an object is only taken as a force if
+// its name is a known force or it contains objects itself.
+func isForceEntities(key string, value jsoniter.Any, forces map[string]bool) bool {
+	if value.ValueType() != jsoniter.ObjectValue {
+		return false
+	}
+	if forces[key] {
+		return true
+	}
+	for _, name := range value.Keys() {
+		if value.Get(name).ValueType() == jsoniter.ObjectValue {
+			return true
+		}
+	}
+	return false
+}
+
+// forEachQuality calls fn with the count of an entity per quality. An entity
+// count is either a number or, with Space Age, an object of counts per
+// quality. Plain numbers are reported with the "normal" quality.
+func forEachQuality(entity jsoniter.Any, fn func(quality string, count float64)) {
+	if entity.ValueType() != jsoniter.ObjectValue {
+		fn("normal", entity.ToFloat64())
+		return
+	}
+	for _, quality := range entity.Keys() {
+		fn(quality, entity.Get(quality).ToFloat64())
+	}
+}
+
+// collectEntityStatusMetrics emits metrics derived from the per-surface
+// entity_status breakdown, which maps entity names to counts per status.
+func (c *Collector) collectEntityStatusMetrics(metrics *metricSet) {
+	for surface_name, surface := range c.data.Surfaces {
+		statuses := surface.EntityStatus
+		if statuses == nil {
+			continue
+		}
+		metrics.gauge("factorio_entities_unpowered_total", "The number of entities without power on a given surface (count).",
+			sumEntityStatus(statuses, "no_power"),
+			"surface", surface_name,
+		)
+		metrics.gauge("factorio_entities_output_full_total", "The number of entities with a full output buffer on a given surface (count).",
+			sumEntityStatus(statuses, "full_output"),
+			"surface", surface_name,
+		)
+		if !c.UnpoweredEntities {
+			continue
+		}
+		for entity_name, counts := range statuses {
+			metrics.gauge("factorio_entity_unpowered_count", "The number of entities of a given prototype without power (count).",
+				counts["no_power"],
+				"name", entity_name,
+				"surface", surface_name,
+			)
+		}
+	}
+}
+
+// sumEntityStatus sums the number of entities in the given status across all
+// prototypes of an entity_status breakdown.
+func sumEntityStatus(statuses map[string]map[string]float64, status string) float64 {
+	total := 0.0
+	for _, counts := range statuses {
+		total += counts[status]
+	}
+	return total
+}
+
+// collectTrainMetrics emits the number of trains per surface. The trains of a
+// surface are either a single count or an object of counts per rail network.
+// Networks are summed unless the network label is enabled, in which case
+// ungrouped counts get an empty network. The train_states of a surface break
+// its trains down by state, such as wait_station or no_path.
+func (c *Collector) collectTrainMetrics(metrics *metricSet) {
+	for surface_name, surface := range c.data.Surfaces {
+		trains := surface.Trains
+		counts := map[string]float64{}
+		switch valueType(trains) {
+		case jsoniter.NumberValue:
+			counts[""] = trains.ToFloat64()
+		case jsoniter.ObjectValue:
+			for _, network := range trains.Keys() {
+				counts[network] = trains.Get(network).ToFloat64()
+			}
+		}
+		for network, count := range counts {
+			labels := []string{}
+			if c.TrainNetworks {
+				labels = append(labels, "network", network)
+			}
+			labels = append(labels, "surface", surface_name)
+			metrics.gauge("factorio_trains_total", "The number of trains on a given surface (count).", count, labels...)
+		}
+		for state, count := range surface.TrainStates {
+			metrics.gauge("factorio_trains_by_state", "The number of trains in a given state on a given surface (count).",
+				count,
+				"state", state,
+				"surface", surface_name,
+			)
+		}
+	}
+}
+
+// collectElectricityMetrics emits the power produced and consumed per electric
+// network and prototype, along with the charge of its accumulators. Networks
+// are read from the top-level electricity section, keyed by surface and
+// network id, or from the electric_networks of each surface. Accumulators
+// summed over a whole surface get an empty network id.
+func (c *Collector) collectElectricityMetrics(metrics *metricSet) {
+	for surface_name, networks := range c.data.Electricity {
+		c.collectElectricNetworks(metrics, surface_name, networks)
+	}
+	for surface_name, surface := range c.data.Surfaces {
+		c.collectElectricNetworks(metrics, surface_name, surface.ElectricNetworks)
+		collectAccumulators(metrics, surface_name, "", surface.Accumulators)
+	}
+}
+
+func collectAccumulators(metrics *metricSet, surface_name, network_id string, accumulators *accumulatorData) {
+	if accumulators == nil {
+		return
+	}
+	metrics.gauge("factorio_accumulator_energy_joules", "The energy stored in accumulators (joules).",
+		accumulators.Energy,
+		"network_id", network_id,
+		"surface", surface_name,
+	)
+	if accumulators.Capacity > 0 {
+		metrics.nonAdditiveGauge("factorio_accumulator_charge_ratio", "The charge of accumulators relative to their capacity (ratio, 0-1).",
+			accumulators.Energy/accumulators.Capacity,
+			"network_id", network_id,
+			"surface", surface_name,
+		)
+	}
+}
+
+func (c *Collector) collectElectricNetworks(metrics *metricSet, surface_name string, networks map[string]electricNetworkData) {
+	for network_id, network := range networks {
+		for prototype, watts := range network.Production {
+			metrics.gauge("factorio_electricity_production_watts", "The power produced by the entities of a given prototype in an electric network (watts).",
+				watts,
+				"network_id", network_id,
+				"prototype", prototype,
+				"surface", surface_name,
+			)
+		}
+		for prototype, watts := range network.Consumption {
+			metrics.gauge("factorio_electricity_consumption_watts", "The power consumed by the entities of a given prototype in an electric network (watts).",
+				watts,
+				"network_id", network_id,
+				"prototype", prototype,
+				"surface", surface_name,
+			)
+		}
+		collectAccumulators(metrics, surface_name, network_id, network.Accumulators)
+		if network.Production == nil && network.Consumption == nil {
+			continue
+		}
+		metrics.nonAdditiveGauge("factorio_electricity_satisfaction_ratio", "The share of the power demand of an electric network that is met, as in the in-game power UI (ratio, 0-1).",
+			electricSatisfaction(network),
+			"network_id", network_id,
+			"surface", surface_name,
+		)
+	}
+}
+
+// electricSatisfaction returns the ratio of the power produced in a network to
+// the power consumed, capped at 1, so that a value below 1 shows the network
+// browning out. A network without consumption is fully satisfied.
+func electricSatisfaction(network electricNetworkData) float64 {
+	production, consumption := 0.0, 0.0
+	for _, watts := range network.Production {
+		production += watts
+	}
+	for _, watts := range network.Consumption {
+		consumption += watts
+	}
+	if consumption <= 0 {
+		return 1
+	}
+	return math.Min(production/consumption, 1)
+}
+
+// collectCircuitMetrics emits the signals of the circuit networks the mod
+// exports, such as the output of a combinator computing a low-resource alarm.
+func (c *Collector) collectCircuitMetrics(metrics *metricSet) {
+	for surface_name, surface := range c.data.Surfaces {
+		for network_id, signals := range surface.CircuitNetworks {
+			for _, signal := range signals {
+				signal_type := signal.Signal.Type
+				if signal_type == "" {
+					signal_type = "item"
+				}
+				metrics.gauge("factorio_circuit_signal_value", "The value of a signal in a circuit network (signal units).",
+					signal.Count,
+					"network_id", network_id,
+					"signal_name", signal.Signal.Name,
+					"signal_type", signal_type,
+					"surface", surface_name,
+				)
+			}
+		}
+	}
+}
+
+// collectLogisticRequestMetrics emits the number of logistic requests that are
+// not fulfilled, per force and surface and optionally per requested item.
+func (c *Collector) collectLogisticRequestMetrics(metrics *metricSet) {
+	for force_name, force := range c.data.Forces {
+		for surface_name, requests := range force.LogisticRequests {
+			if unfulfilled := requests.Unfulfilled; unfulfilled != nil {
+				metrics.gauge("factorio_logistic_requests_unfulfilled_total", "The number of logistic requests that are not fulfilled (count).",
+					*unfulfilled,
+					"force", force_name,
+					"surface", surface_name,
+				)
+			}
+			if !c.LogisticRequests {
+				continue
+			}
+			for item_name, count := range requests.UnfulfilledItems {
+				metrics.gauge("factorio_logistic_requests_unfulfilled_items", "The number of requested items that are not delivered (items).",
+					count,
+					"force", force_name,
+					"item", item_name,
+					"surface", surface_name,
+				)
+			}
+		}
+	}
+}
+
+// collectLogisticMetrics emits the items stored in each logistic network along
+// with the available and total number of robots per robot type.
+func (c *Collector) collectLogisticMetrics(metrics *metricSet) {
+	for force_name, force := range c.data.Forces {
+		for surface_name, networks := range force.LogisticNetworks {
+			for network_id, network := range networks {
+				for item_name, count := range network.Contents {
+					metrics.gauge("factorio_logistic_network_item_count", "The number of items stored in a logistic network (items).",
+						count,
+						"force", force_name,
+						"item", item_name,
+						"network_id", network_id,
+						"surface", surface_name,
+					)
+				}
+				for robot_type, robots := range network.Robots {
+					if available := robots.Available; available != nil {
+						metrics.gauge("factorio_logistic_bots_available", "The number of idle robots of a given type in a logistic network (count).",
+							*available,
+							"force", force_name,
+							"network_id", network_id,
+							"surface", surface_name,
+							"type", robot_type,
+						)
+					}
+					if total := robots.Total; total != nil {
+						metrics.gauge("factorio_logistic_bots_total", "The number of robots of a given type in a logistic network (count).",
+							*total,
+							"force", force_name,
+							"network_id", network_id,
+							"surface", surface_name,
+							"type", robot_type,
+						)
+					}
+				}
+			}
+		}
+	}
+}
+
+func (c *Collector) collectRecipeMetrics(metrics *metricSet) {
+	for surface_name, surface := range c.data.Surfaces {
+		for recipe_name, recipe := range surface.Recipes {
+			if recipe.Machines == nil {
+				continue
+			}
+			metrics.gauge("factorio_recipe_machines_total", "The number of crafting machines set to a given recipe (count).",
+				*recipe.Machines,
+				"recipe", recipe_name,
+				"surface", surface_name,
+			)
+		}
+	}
+}
+
+func (c *Collector) collectRocketMetrics(metrics *metricSet) {
+	for force_name, force := range c.data.Forces {
+		metrics.counter("factorio_rockets_launched", "The total number of rockets launched (count).",
+			orZero(force.Rockets.Launches),
+			"force", force_name,
+		)
+		c.collectLaunchRate(metrics, force_name, force.Rockets.Launches)
+		c.collectLastLaunchTick(metrics, force_name, force.Rockets.LastLaunchTick)
+		itemsLaunched := 0.0
+		for item_name, count := range force.Rockets.Items {
+			itemsLaunched += count
+			metrics.counter("factorio_items_launched", "The total number of items launched in rockets (items).",
+				count,
+				"force", force_name,
+				"name", item_name,
+			)
+		}
+		metrics.counter("factorio_items_launched_sum_total", "The total number of items of all kinds launched in rockets (items).",
+			itemsLaunched,
+			"force", force_name,
+		)
+	}
+}
+
+// collectLaunchRate emits the number of rockets launched by a force per minute
+// of game time since the previous sample. Like the evolution rate, it is
+// omitted until two samples exist and restarts when the launch count resets.
+func (c *Collector) collectLaunchRate(metrics *metricSet, force_name string, launches *float64) {
+	if launches == nil {
+		return
+	}
+	if c.launches == nil {
+		c.launches = make(map[string]rateSample)
+	}
+	sample, ok := c.launches[force_name]
+	if ok && *launches > sample.value {
+		if c.lastLaunches == nil {
+			c.lastLaunches = make(map[string]float64)
+		}
+		c.lastLaunches[force_name] = c.data.tick()
+	}
+	sample = sample.next(ok, c.data.tick(), *launches)
+	c.launches[force_name] = sample
+
+	if sample.hasRate {
+		metrics.gauge("factorio_rocket_launch_rate", "The number of rockets launched by a force per minute of game time (rockets per minute).",
+			sample.rate*ticksPerMinute,
+			"force", force_name,
+		)
+	}
+}
+
+// collectLastLaunchTick emits the game tick of the last rocket launch of a
+// force, which ties launches to game time rather than to the time of the
+// scrape. Without a tick from the mod, it is the tick of the first collection
+// that saw the launch count increase, so launches before the exporter started
+// are not reported.
+func (c *Collector) collectLastLaunchTick(metrics *metricSet, force_name string, lastLaunch *float64) {
+	tick, ok := c.lastLaunches[force_name]
+	if lastLaunch != nil {
+		tick, ok = *lastLaunch, true
+	}
+	if !ok {
+		return
+	}
+	metrics.nonAdditiveGauge("factorio_last_rocket_launch_tick", "The game tick of the last rocket launch of a force (ticks).",
+		tick,
+		"force", force_name,
+	)
+}
+
+func (c *Collector) collectUnknownKeyMetrics(metrics *metricSet) {
+	known := c.data.topLevelFields()
+	var unknown []string
+	for _, key := range c.data.keys {
+		if _, ok := known[key]; !ok {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		slog.Debug("Found unknown top-level keys", "keys", unknown)
+	}
+	metrics.gauge("factorio_exporter_unknown_top_level_keys", "The number of top-level keys in the JSON that the exporter does not consume (count).",
+		float64(len(unknown)),
+	)
+}
+
+// readMetricsData reads the metrics data from the JSON file, or from the
+// latest event if the source is an event stream.
+func (c *Collector) readMetricsData() error {
+	if c.stream != nil {
+		data, received, err := c.stream.latest()
+		if err != nil {
+			return fmt.Errorf("failed to read event stream: %w", err)
+		}
+		if c.data != nil && received.Equal(c.dataReceived) {
+			return nil
+		}
+		parsed, err := parseMetricsData(data, c.MaxReadBytes)
+		if err != nil {
+			return err
+		}
+		c.data = parsed
+		c.dataReceived = received
+		return nil
+	}
+	if IsHTTPSource(c.MetricsPath) {
+		return c.fetchMetricsData()
+	}
+
+	// A read that is stuck, for example on an unresponsive network mount, is
+	// abandoned after the timeout. Later reads wait for the same attempt
+	// rather than starting more goroutines that block as well.
+	if c.pendingRead == nil {
+		c.pendingRead = make(chan fileRead, 1)
+		go func(result chan<- fileRead, path string, cached bool, modTime time.Time, size int64, maxBytes int) {
+			result <- readMetricsFile(path, cached, modTime, size, maxBytes)
+		}(c.pendingRead, c.MetricsPath, c.data != nil, c.dataModTime, c.dataSize, c.MaxReadBytes)
+	}
+	ctx := context.Background()
+	if c.ReadTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.ReadTimeout)
+		defer cancel()
+	}
+	var read fileRead
+	select {
+	case read = <-c.pendingRead:
+		c.pendingRead = nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out reading metrics file after %s", c.ReadTimeout)
+	}
+
+	// The modification time is kept even if reading fails, so a file that
+	// stopped being written shows up as aging rather than disappearing.
+	if read.info == nil {
+		c.modTime = time.Time{}
+	} else {
+		c.modTime = read.info.ModTime()
+	}
+	if read.err != nil {
+		return read.err
+	}
+	if read.data != nil {
+		c.data = read.data
+		c.dataModTime = read.info.ModTime()
+		c.dataSize = read.info.Size()
+	}
+	return nil
+}
+
+// fetchMetricsData fetches the metrics data from an http or https source. The
+// Last-Modified time of the document stands in for the modification time of
+// a file.
+func (c *Collector) fetchMetricsData() error {
+	if c.http == nil {
+		c.http = newHTTPSource(c.MetricsPath, c.ReadTimeout, c.MaxReadBytes)
+	}
+	data, modTime, err := c.http.fetch(context.Background(), c.data != nil)
+	c.modTime = modTime
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		c.data = data
+		c.dataReceived = time.Now()
+	}
+	return nil
+}
+
+// fileRead is the outcome of reading the metrics file. data is nil if the file
+// did not change since it was last read.
+type fileRead struct {
+	info os.FileInfo
+	data *metricsData
+	err  error
+}
+
+// readRetryDelays are the delays before retrying to read a metrics file that
+// could not be parsed. The mod may be in the middle of writing it, so a later
+// read usually succeeds.
+var readRetryDelays = []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}
+
+// readMetricsFile reads the metrics file at path, retrying after each of the
+// readRetryDelays while it cannot be parsed. It does not touch the collector,
+// so that it can be abandoned when it blocks.
+func readMetricsFile(path string, cached bool, modTime time.Time, size int64, maxBytes int) fileRead {
+	read := readMetricsFileOnce(path, cached, modTime, size, maxBytes)
+	for _, delay := range readRetryDelays {
+		var parseErr *parseError
+		if !errors.As(read.err, &parseErr) {
+			break
+		}
+		slog.Debug("Retrying to read the metrics file", "path", path, "error", read.err, "retry_in", delay)
+		time.Sleep(delay)
+		read = readMetricsFileOnce(path, cached, modTime, size, maxBytes)
+	}
+	return read
+}
+
+// readMetricsFileOnce stats the metrics file at path and reads and parses it
+// unless the cached data has the same modification time and size. A rewrite
+// that keeps both goes unnoticed. Files that are not regular files, such as
+// FIFOs, are limited to maxBytes since their size is not known up front.
+func readMetricsFileOnce(path string, cached bool, modTime time.Time, size int64, maxBytes int) fileRead {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileRead{err: fmt.Errorf("failed to stat metrics file: %w", err)}
+	}
+	if cached && info.ModTime().Equal(modTime) && info.Size() == size {
+		return fileRead{info: info}
+	}
+
+	if info.Mode().IsRegular() {
+		maxBytes = 0
+	}
+	data, err := readWholeMetricsFile(path, maxBytes)
+	return fileRead{info: info, data: data, err: err}
+}
+
+// readWholeMetricsFile parses the JSON file while reading it, so that only the
+// parsed document is held in memory rather than the file contents as well.
+func readWholeMetricsFile(path string, maxBytes int) (*metricsData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics file: %w", err)
+	}
+	defer file.Close()
+
+	return parseMetricsReader(file, maxBytes)
+}
+
+// parseMetricsData parses a complete metrics document.
+func parseMetricsData(data []byte, maxBytes int) (*metricsData, error) {
+	return parseMetricsReader(bytes.NewReader(data), maxBytes)
+}
+
+// gzipMagic is the prefix of gzip-compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// parseBufferSize is the size of the buffer the metrics data is parsed from.
+const parseBufferSize = 64 << 10
+
+// parseMetricsReader parses the metrics document read from r, decompressing it
+// on the fly if it is gzip-compressed. Compression is detected from the content
+// rather than the file name, so it works for event streams and renamed files
+// alike. Truncated documents, values of an unexpected type and documents
+// without any top-level sections are reported as errors, the latter since an
+// empty file would otherwise pass for a game at tick 0. Unless maxBytes is
+// zero, documents that are larger once decompressed fail as well, so that a
+// small compressed document cannot exhaust the memory.
+func parseMetricsReader(r io.Reader, maxBytes int) (*metricsData, error) {
+	buffered := bufio.NewReaderSize(r, parseBufferSize)
+	var reader io.Reader = buffered
+	if magic, _ := buffered.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		decompressed, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress metrics data: %w", err)
+		}
+		defer decompressed.Close()
+		reader = decompressed
+	}
+	var limited *limitedReader
+	if maxBytes > 0 {
+		limited = &limitedReader{r: reader, remaining: int64(maxBytes)}
+		reader = limited
+	}
+
+	iter := jsoniter.Parse(metricsConfig, reader, parseBufferSize)
+	data := decodeMetricsData(iter)
+	if limited != nil && limited.remaining < 0 {
+		return nil, fmt.Errorf("metrics data exceeds %d bytes", maxBytes)
+	}
+	if iter.Error != nil {
+		return nil, &parseError{err: iter.Error}
+	}
+	if len(data.keys) == 0 {
+		return nil, &parseError{err: errEmptyMetricsData}
+	}
+	return data, nil
+}
+
+var errEmptyMetricsData = errors.New("metrics data contains no sections")
+
+// errReadLimit is returned by a limitedReader once its limit is exceeded.
+var errReadLimit = errors.New("read limit exceeded")
+
+// limitedReader reads from r until more than remaining bytes were read. Unlike
+// io.LimitReader, it fails rather than ending early, so that an oversized
+// document is not mistaken for a truncated one.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, errReadLimit
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errReadLimit
+	}
+	return n, err
+}
+
+// parseError is the error of metrics data that could not be parsed, such as a
+// file that was read while it was being written.
+type parseError struct {
+	err error
+}
+
+func (e *parseError) Error() string {
+	return "failed to parse metrics data: " + e.err.Error()
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// Healthy reports whether the metrics data can currently be read. Unchanged
+// files are served from the cache, so this only costs a stat in the common case.
+func (c *Collector) Healthy() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.readMetricsData()
+}
+
+// expectedSections are the top-level sections the mod always writes.
+var expectedSections = []string{"game", "players", "forces", "pollution", "surfaces"}
+
+// Validation describes the top-level structure of the metrics data.
+type Validation struct {
+	// Sections are the top-level sections the collector consumes, in the
+	// order of the document.
+	Sections []string
+	// Missing are the sections the mod always writes that the data lacks.
+	Missing []string
+	// Unknown are the top-level keys the collector does not consume.
+	Unknown []string
+}
+
+// Validate reads and parses the metrics data and describes its structure. It
+// returns an error if the data cannot be read or parsed.
+func (c *Collector) Validate() (Validation, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.readMetricsData(); err != nil {
+		return Validation{}, err
+	}
+
+	var validation Validation
+	known := c.data.topLevelFields()
+	found := make(map[string]bool, len(c.data.keys))
+	for _, key := range c.data.keys {
+		found[key] = true
+		if _, ok := known[key]; ok {
+			validation.Sections = append(validation.Sections, key)
+		} else {
+			validation.Unknown = append(validation.Unknown, key)
+		}
+	}
+	for _, section := range expectedSections {
+		if !found[section] {
+			validation.Missing = append(validation.Missing, section)
+		}
+	}
+	return validation, nil
+}
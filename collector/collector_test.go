@@ -0,0 +1,1847 @@
+package collector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+var update = flag.Bool("update", false, "rewrite the expected output of TestCollectFixture in testdata")
+
+// newTestCollector returns a collector reading the given JSON document, with
+// all optional collectors enabled.
+func newTestCollector(t *testing.T, json string) *Collector {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := os.WriteFile(path, []byte(json), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return &Collector{
+		MetricsPath:       path,
+		CollectRecipes:    true,
+		UnpoweredEntities: true,
+		DefaultForce:      "player",
+	}
+}
+
+// TestCollectFixture runs every collector on its own over testdata/metrics.json
+// and compares its metrics with testdata/collect/<name>.prom. Run the tests
+// with -update to rewrite the expected output after an intended change.
+func TestCollectFixture(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/metrics.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gather := func(t *testing.T, enabled string) []*dto.MetricFamily {
+		t.Helper()
+		collector := newTestCollector(t, string(fixture))
+		collector.DisabledCollectors = make(map[string]bool)
+		for _, name := range CollectorNames() {
+			collector.DisabledCollectors[name] = name != enabled
+		}
+		registry := prometheus.NewPedanticRegistry()
+		registry.MustRegister(collector)
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return families
+	}
+
+	// The exporter's own metrics are reported whichever collectors run.
+	common := make(map[string]bool)
+	for _, family := range gather(t, "") {
+		common[family.GetName()] = true
+	}
+
+	for _, name := range CollectorNames() {
+		t.Run(name, func(t *testing.T) {
+			var got bytes.Buffer
+			for _, family := range gather(t, name) {
+				if common[family.GetName()] || strings.HasPrefix(family.GetName(), "factorio_exporter_") {
+					continue
+				}
+				if _, err := expfmt.MetricFamilyToText(&got, family); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			path := filepath.Join("testdata", "collect", name+".prom")
+			if *update {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, got.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != string(expected) {
+				t.Errorf("got:\n%s\nwant:\n%s", got.String(), expected)
+			}
+		})
+	}
+}
+
+func TestLabelNames(t *testing.T) {
+	known := make(map[string]bool)
+	for _, name := range LabelNames() {
+		known[name] = true
+	}
+	metadata := filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(metadata, []byte(`{"stone-furnace": {"type": "furnace", "display_name": "Stone furnace", "category": "smelting", "stack_size": 50}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fixture := range []string{"testdata/metrics.json", "testdata/trains_by_network.json", "testdata/entities_by_force.json"} {
+		for _, aggregation := range []string{"name", "type"} {
+			json, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			collector := newTestCollector(t, string(json))
+			collector.EntityAggregation = aggregation
+			collector.MetadataPath = metadata
+			collector.EntityQuality = true
+			collector.TrainNetworks = true
+			collector.PlayerInventory = true
+			collector.LogisticRequests = true
+			collector.SurfaceClock = true
+			registry := prometheus.NewPedanticRegistry()
+			registry.MustRegister(collector)
+			families, err := registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, family := range families {
+				for _, metric := range family.GetMetric() {
+					for _, label := range metric.GetLabel() {
+						if !known[label.GetName()] {
+							t.Errorf("%s: label %q is missing from LabelNames", family.GetName(), label.GetName())
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestCollectMissingSubtrees(t *testing.T) {
+	forceFamilies := []string{
+		"factorio_force_research_progress",
+		"factorio_force_research_queue_length",
+		"factorio_force_current_research",
+		"factorio_force_science_per_minute",
+		"factorio_force_research_progress_rate",
+		"factorio_force_evolution_factor",
+		"factorio_force_evolution_rate",
+		"factorio_force_pollution_produced_total",
+		"factorio_force_manual_crafts_total",
+		"factorio_force_machine_crafts_total",
+		"factorio_force_kills_total",
+		"factorio_force_deaths_total",
+		"factorio_force_prototype_production",
+		"factorio_force_prototype_consumption",
+		"factorio_rockets_launched",
+		"factorio_rocket_launch_rate",
+		"factorio_items_launched",
+		"factorio_items_launched_sum_total",
+		"factorio_logistic_network_item_count",
+		"factorio_logistic_bots_available",
+		"factorio_logistic_bots_total",
+	}
+	surfaceFamilies := []string{
+		"factorio_surface_pollution_total",
+		"factorio_surface_ticks_per_day",
+		"factorio_surface_daytime",
+		"factorio_surface_darkness",
+		"factorio_radars_total",
+		"factorio_artillery_total",
+		"factorio_surface_update_cost_ms",
+		"factorio_surface_enemy_groups_total",
+		"factorio_surface_enemy_chunks_total",
+		"factorio_surface_chunks_generated",
+		"factorio_surface_chunks_charted",
+		"factorio_surface_next_attack_estimate_ticks",
+		"factorio_lamps_on_total",
+		"factorio_rail_signals_total",
+		"factorio_resource_amount",
+		"factorio_trains_total",
+		"factorio_trains_by_state",
+		"factorio_electricity_production_watts",
+		"factorio_electricity_consumption_watts",
+		"factorio_electricity_satisfaction_ratio",
+		"factorio_circuit_signal_value",
+		"factorio_entity_count",
+		"factorio_entities_unpowered_total",
+		"factorio_entities_output_full_total",
+		"factorio_entity_unpowered_count",
+		"factorio_recipe_machines_total",
+	}
+
+	tests := []struct {
+		name     string
+		json     string
+		families []string
+	}{
+		{
+			name:     "no forces",
+			json:     `{"game": {"time": {"tick": 60}}, "surfaces": {}}`,
+			families: forceFamilies,
+		},
+		{
+			name:     "no surfaces",
+			json:     `{"game": {"time": {"tick": 60}}, "forces": {}}`,
+			families: surfaceFamilies,
+		},
+		{
+			name:     "empty players",
+			json:     `{"players": {}}`,
+			families: []string{"factorio_player_connected"},
+		},
+		{
+			name:     "no pollution",
+			json:     `{"surfaces": {}}`,
+			families: []string{"factorio_surface_pollution_production", "factorio_surface_pollution_emitted", "factorio_surface_pollution_absorbed"},
+		},
+		{
+			name: "force without subtrees",
+			json: `{"forces": {"player": {}}}`,
+			families: []string{
+				"factorio_force_science_per_minute",
+				"factorio_force_research_progress_rate",
+				"factorio_force_evolution_rate",
+				"factorio_force_pollution_produced_total",
+				"factorio_force_manual_crafts_total",
+				"factorio_force_machine_crafts_total",
+				"factorio_force_kills_total",
+				"factorio_force_deaths_total",
+				"factorio_force_prototype_production",
+				"factorio_force_prototype_consumption",
+				"factorio_items_launched",
+			},
+		},
+		{
+			name: "surface without subtrees",
+			json: `{"surfaces": {"nauvis": {}}}`,
+			families: []string{
+				"factorio_surface_daytime",
+				"factorio_surface_darkness",
+				"factorio_radars_total",
+				"factorio_artillery_total",
+				"factorio_surface_update_cost_ms",
+				"factorio_surface_enemy_groups_total",
+				"factorio_surface_enemy_chunks_total",
+				"factorio_surface_chunks_generated",
+				"factorio_surface_chunks_charted",
+				"factorio_surface_next_attack_estimate_ticks",
+				"factorio_lamps_on_total",
+				"factorio_rail_signals_total",
+				"factorio_resource_amount",
+				"factorio_trains_total",
+				"factorio_trains_by_state",
+				"factorio_electricity_production_watts",
+				"factorio_electricity_consumption_watts",
+				"factorio_electricity_satisfaction_ratio",
+				"factorio_circuit_signal_value",
+				"factorio_entity_count",
+				"factorio_entities_unpowered_total",
+				"factorio_entities_output_full_total",
+				"factorio_entity_unpowered_count",
+				"factorio_recipe_machines_total",
+			},
+		},
+		{
+			name:     "only game",
+			json:     `{"game": {}}`,
+			families: append(append([]string{"factorio_player_connected", "factorio_surface_pollution_production"}, forceFamilies...), surfaceFamilies...),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := newTestCollector(t, tt.json)
+			for _, family := range tt.families {
+				if count := testutil.CollectAndCount(collector, family); count != 0 {
+					t.Errorf("%s: got %d metrics, want 0", family, count)
+				}
+			}
+		})
+	}
+}
+
+func TestRateSample(t *testing.T) {
+	var sample rateSample
+	sample = sample.next(false, 100, 1)
+	if sample.hasRate {
+		t.Fatal("rate available after the first sample")
+	}
+	sample = sample.next(true, 100, 1)
+	if sample.hasRate {
+		t.Fatal("rate available without the tick advancing")
+	}
+	sample = sample.next(true, 200, 3)
+	if !sample.hasRate || sample.rate != 0.02 {
+		t.Fatalf("got rate %v (available %v), want 0.02", sample.rate, sample.hasRate)
+	}
+	sample = sample.next(true, 50, 0)
+	if sample.hasRate {
+		t.Fatal("rate available after a reset")
+	}
+}
+
+func TestNormalizeLabelsMergesSeries(t *testing.T) {
+	collector := newTestCollector(t, `{
+		"players": {"Alice": {"connected": true}, " alice": {"connected": true}},
+		"surfaces": {"nauvis": {"entities": {"Stone-Furnace": 2, " stone-furnace": 3}}}
+	}`)
+	collector.NormalizeLabels = true
+
+	// Entity counts add up, while a player that is connected under two
+	// spellings is still connected once.
+	expected := `
+# HELP factorio_entity_count The total number of entities (count).
+# TYPE factorio_entity_count gauge
+factorio_entity_count{force="player",name="stone-furnace",surface="nauvis"} 5
+# HELP factorio_player_connected The current connection state of the player (boolean).
+# TYPE factorio_player_connected gauge
+factorio_player_connected{username="alice"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_entity_count", "factorio_player_connected"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLabelMapMergesSeries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "labels.json")
+	if err := os.WriteFile(path, []byte(`{"force": {"team-a": "team", "team-b": "team"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	labels, err := LoadLabelMap(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := newTestCollector(t, `{"forces": {
+		"team-a": {"research": {"progress": 0.5}, "kills": {"biter": 3}},
+		"team-b": {"research": {"progress": 0.75}, "kills": {"biter": 5}},
+		"player": {"research": {"progress": 0.25}, "kills": {"biter": 1}}
+	}}`)
+	collector.LabelMap = labels
+
+	// Kills add up, while the research progress of the merged forces keeps
+	// the largest value rather than exceeding 1.
+	expected := `
+# HELP factorio_force_kills_total The total number of entities killed by a force (count).
+# TYPE factorio_force_kills_total counter
+factorio_force_kills_total{force="player",victim_type="biter"} 1
+factorio_force_kills_total{force="team",victim_type="biter"} 8
+# HELP factorio_force_research_progress The current research progress for a force (ratio, 0-1).
+# TYPE factorio_force_research_progress gauge
+factorio_force_research_progress{force="player"} 0.25
+factorio_force_research_progress{force="team"} 0.75
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_force_kills_total", "factorio_force_research_progress"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlayerTime(t *testing.T) {
+	collector := newTestCollector(t, `{"players": {
+		"alice": {"connected": true, "online_time": 216000, "afk_time": 90},
+		"bob": {"connected": false}
+	}}`)
+
+	expected := `
+# HELP factorio_player_afk_time_seconds The game time since the player was last active (seconds).
+# TYPE factorio_player_afk_time_seconds gauge
+factorio_player_afk_time_seconds{username="alice"} 1.5
+# HELP factorio_player_online_time_seconds The total game time the player has been connected for (seconds).
+# TYPE factorio_player_online_time_seconds counter
+factorio_player_online_time_seconds{username="alice"} 3600
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_player_afk_time_seconds", "factorio_player_online_time_seconds"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlayersOnline(t *testing.T) {
+	tests := []struct {
+		json     string
+		expected string
+	}{
+		{json: `{"players": {"alice": {"connected": true}, "bob": {"connected": false}, "carol": {"connected": true}}}`, expected: "2"},
+		{json: `{"players": []}`, expected: "0"},
+		{json: `{"game": {}}`, expected: "0"},
+	}
+	for _, tt := range tests {
+		collector := newTestCollector(t, tt.json)
+		expected := `
+# HELP factorio_players_online The number of connected players (count).
+# TYPE factorio_players_online gauge
+factorio_players_online ` + tt.expected + "\n"
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_players_online"); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+		}
+	}
+}
+
+func TestPlayerPosition(t *testing.T) {
+	collector := newTestCollector(t, `{"players": {
+		"alice": {"connected": true, "surface": "nauvis", "position": {"x": 12.5, "y": -3}},
+		"bob": {"connected": false, "surface": "vulcanus", "position": {"x": 100, "y": 200}}
+	}}`)
+
+	expected := `
+# HELP factorio_player_position_x The x coordinate of a connected player (tiles).
+# TYPE factorio_player_position_x gauge
+factorio_player_position_x{username="alice"} 12.5
+# HELP factorio_player_position_y The y coordinate of a connected player (tiles).
+# TYPE factorio_player_position_y gauge
+factorio_player_position_y{username="alice"} -3
+# HELP factorio_player_surface The surface a player is on, always 1 (info).
+# TYPE factorio_player_surface gauge
+factorio_player_surface{surface="nauvis",username="alice"} 1
+factorio_player_surface{surface="vulcanus",username="bob"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_player_position_x", "factorio_player_position_y", "factorio_player_surface"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPlayerInventory(t *testing.T) {
+	collector := newTestCollector(t, `{"players": {
+		"alice": {"connected": true, "inventory": {"nuclear-fuel": 3, "iron-plate": 200}}
+	}}`)
+
+	if count := testutil.CollectAndCount(collector, "factorio_player_inventory_item_count"); count != 0 {
+		t.Errorf("got %d inventory series without -collect-player-inventory, want 0", count)
+	}
+
+	collector.PlayerInventory = true
+	expected := `
+# HELP factorio_player_inventory_item_count The number of items of a given kind in the main inventory of a player (items).
+# TYPE factorio_player_inventory_item_count gauge
+factorio_player_inventory_item_count{item="iron-plate",username="alice"} 200
+factorio_player_inventory_item_count{item="nuclear-fuel",username="alice"} 3
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_player_inventory_item_count"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResearch(t *testing.T) {
+	collector := newTestCollector(t, `{"forces": {
+		"player": {"research": {"progress": 0.5, "current": "automation", "queue": ["automation", "logistics"]}},
+		"idle": {"research": {"progress": 0, "current": "", "queue": []}}
+	}}`)
+
+	expected := `
+# HELP factorio_force_current_research The technology currently researched by a force, always 1 (info).
+# TYPE factorio_force_current_research gauge
+factorio_force_current_research{force="player",technology="automation"} 1
+# HELP factorio_force_research_queue_length The number of technologies in the research queue of a force (count).
+# TYPE factorio_force_research_queue_length gauge
+factorio_force_research_queue_length{force="idle"} 0
+factorio_force_research_queue_length{force="player"} 2
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_force_current_research", "factorio_force_research_queue_length"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEvolutionFactor(t *testing.T) {
+	collector := newTestCollector(t, `{"forces": {
+		"enemy": {"evolution_factor": 0.25},
+		"space-enemy": {"evolution_factor": {"nauvis": 0.5, "gleba": 0.125}}
+	}}`)
+
+	expected := `
+# HELP factorio_force_evolution_factor The evolution factor of a force (ratio, 0-1).
+# TYPE factorio_force_evolution_factor gauge
+factorio_force_evolution_factor{force="enemy",surface=""} 0.25
+factorio_force_evolution_factor{force="space-enemy",surface="gleba"} 0.125
+factorio_force_evolution_factor{force="space-enemy",surface="nauvis"} 0.5
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_force_evolution_factor"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNonFiniteSamples(t *testing.T) {
+	for _, zero := range []bool{false, true} {
+		collector := &Collector{ZeroNonFinite: zero}
+		metrics := collector.newMetricSet()
+		metrics.gauge("factorio_test", "A test gauge (count).", math.NaN(), "case", "nan")
+		metrics.gauge("factorio_test", "A test gauge (count).", math.Inf(1), "case", "inf")
+		metrics.gauge("factorio_test", "A test gauge (count).", 1, "case", "finite")
+
+		ch := make(chan prometheus.Metric, 3)
+		metrics.emit(ch)
+		close(ch)
+		var values []float64
+		for metric := range ch {
+			var m dto.Metric
+			if err := metric.Write(&m); err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, m.GetGauge().GetValue())
+		}
+
+		expected := []float64{1}
+		if zero {
+			expected = []float64{0, 0, 1}
+		}
+		if !reflect.DeepEqual(values, expected) {
+			t.Errorf("zero=%v: got values %v, want %v", zero, values, expected)
+		}
+	}
+}
+
+func TestExemplars(t *testing.T) {
+	tick := 123456.0
+	for _, exemplars := range []bool{false, true} {
+		collector := &Collector{Exemplars: exemplars, data: &metricsData{}}
+		collector.data.Game.Time.Tick = &tick
+		metrics := collector.newMetricSet()
+		metrics.counter("factorio_test_total", "A test counter (count).", 5)
+
+		ch := make(chan prometheus.Metric, 1)
+		metrics.emit(ch)
+		close(ch)
+		var m dto.Metric
+		if err := (<-ch).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+
+		exemplar := m.GetCounter().GetExemplar()
+		if !exemplars {
+			if exemplar != nil {
+				t.Errorf("got exemplar %v without -exemplars", exemplar)
+			}
+			continue
+		}
+		labels := exemplar.GetLabel()
+		if len(labels) != 1 || labels[0].GetName() != "tick" || labels[0].GetValue() != "123456" || exemplar.GetValue() != 5 {
+			t.Errorf("got exemplar %v, want {tick=\"123456\"} 5", exemplar)
+		}
+	}
+}
+
+func TestExemplarsTotalSuffix(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 600}}, "forces": {"player": {
+		"items": {"nauvis": {"iron-plate": {"production": 10, "consumption": 4}}},
+		"rockets": {"launches": 2, "items": {"satellite": 1}}
+	}}}`)
+	collector.Exemplars = true
+	collector.TotalSuffix = true
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"factorio_force_prototype_production_total":  false,
+		"factorio_force_prototype_consumption_total": false,
+		"factorio_rockets_launched_total":            false,
+		"factorio_items_launched_total":              false,
+	}
+	for _, family := range families {
+		if family.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		if !strings.HasSuffix(family.GetName(), "_total") {
+			t.Errorf("%s: got a counter without the _total suffix", family.GetName())
+		}
+		if strings.HasPrefix(family.GetName(), "factorio_exporter_") {
+			// The exporter's own counters are not tied to the game tick.
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			exemplar := metric.GetCounter().GetExemplar()
+			if exemplar == nil || exemplar.GetLabel()[0].GetValue() != "600" {
+				t.Errorf("%s: got exemplar %v, want {tick=\"600\"}", family.GetName(), exemplar)
+			}
+		}
+		if _, ok := want[family.GetName()]; ok {
+			want[family.GetName()] = true
+		}
+	}
+	for name, found := range want {
+		if !found {
+			t.Errorf("missing %s", name)
+		}
+	}
+}
+
+func TestEntityQuality(t *testing.T) {
+	const json = `{"surfaces": {"nauvis": {"entities": {"stone-furnace": 2, "assembling-machine-3": {"normal": 4, "rare": 1}}}}}`
+
+	tests := []struct {
+		name          string
+		entityQuality bool
+		expected      string
+	}{
+		{
+			name: "summed",
+			expected: `
+# HELP factorio_entity_count The total number of entities (count).
+# TYPE factorio_entity_count gauge
+factorio_entity_count{force="player",name="assembling-machine-3",surface="nauvis"} 5
+factorio_entity_count{force="player",name="stone-furnace",surface="nauvis"} 2
+`,
+		},
+		{
+			name:          "quality label",
+			entityQuality: true,
+			expected: `
+# HELP factorio_entity_count The total number of entities (count).
+# TYPE factorio_entity_count gauge
+factorio_entity_count{force="player",name="assembling-machine-3",quality="normal",surface="nauvis"} 4
+factorio_entity_count{force="player",name="assembling-machine-3",quality="rare",surface="nauvis"} 1
+factorio_entity_count{force="player",name="stone-furnace",quality="normal",surface="nauvis"} 2
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			collector := newTestCollector(t, json)
+			collector.EntityQuality = tt.entityQuality
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected), "factorio_entity_count"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestActivePrototypes(t *testing.T) {
+	collector := newTestCollector(t, `{"forces": {"player": {
+		"items": {
+			"nauvis": {"iron-plate": {"production": 10}, "copper-plate": {"production": 0, "consumption": 5}},
+			"vulcanus": {"iron-plate": {"production": 3}}
+		},
+		"fluids": {"nauvis": {"water": {"production": 100}}}
+	}}}`)
+
+	expected := `
+# HELP factorio_force_active_prototypes_total The number of distinct item and fluid prototypes with nonzero production for a force (count).
+# TYPE factorio_force_active_prototypes_total gauge
+factorio_force_active_prototypes_total{force="player"} 2
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_force_active_prototypes_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPrototypeInfo(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {}}`)
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	collector.MetadataPath = path
+
+	if count := testutil.CollectAndCount(collector, "factorio_prototype_info"); count != 0 {
+		t.Errorf("got %d metrics without a metadata file, want 0", count)
+	}
+
+	metadata := `{"iron-plate": {"type": "item", "display_name": "Iron plate", "category": "raw-material", "stack_size": 100}}`
+	if err := os.WriteFile(path, []byte(metadata), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP factorio_prototype_info Static metadata of a prototype, always 1 (info).
+# TYPE factorio_prototype_info gauge
+factorio_prototype_info{category="raw-material",display_name="Iron plate",prototype="iron-plate",stack_size="100",type="item"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_prototype_info"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEntityAggregationByType(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {"nauvis": {"entities": {
+		"assembling-machine-1": 4, "assembling-machine-2": 6, "transport-belt": 300, "se-core-miner": 1
+	}}}}`)
+	collector.EntityAggregation = "type"
+	collector.MetadataPath = filepath.Join(t.TempDir(), "metadata.json")
+	metadata := `{
+		"assembling-machine-1": {"type": "assembling-machine"},
+		"assembling-machine-2": {"type": "assembling-machine"},
+		"transport-belt": {"type": "transport-belt"}
+	}`
+	if err := os.WriteFile(collector.MetadataPath, []byte(metadata), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP factorio_entity_count The total number of entities (count).
+# TYPE factorio_entity_count gauge
+factorio_entity_count{force="player",surface="nauvis",type="assembling-machine"} 10
+factorio_entity_count{force="player",surface="nauvis",type="transport-belt"} 300
+factorio_entity_count{force="player",surface="nauvis",type="unknown"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_entity_count"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSurfaceInclude(t *testing.T) {
+	collector := newTestCollector(t, `{
+		"players": {"alice": {"surface": "nauvis"}, "bob": {"surface": "vulcanus"}},
+		"forces": {"player": {
+			"evolution_factor": {"nauvis": 0.5, "gleba": 0.25},
+			"items": {"nauvis": {"iron-plate": {"production": 10}}, "vulcanus": {"tungsten-plate": {"production": 3}}},
+			"logistic_networks": {"platform-1": {"1": {"contents": {"iron-plate": 5}}}}
+		}},
+		"pollution": {"nauvis": {"boiler": 5}, "gleba": {"biochamber": {"spores": 2}}},
+		"electricity": {"vulcanus": {"1": {"production": {"steam-turbine": 1000}}}},
+		"surfaces": {
+			"nauvis": {"pollution": 9, "entities": {"stone-furnace": 2}},
+			"vulcanus": {"pollution": 1, "entities": {"big-mining-drill": 4}},
+			"platform-1": {"entities": {"asteroid-collector": 2}}
+		}
+	}`)
+	collector.SurfaceInclude = regexp.MustCompile(`^nauvis$`)
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+
+	for range 2 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		surfaces := 0
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				for _, label := range metric.GetLabel() {
+					if label.GetName() != "surface" {
+						continue
+					}
+					surfaces++
+					if label.GetValue() != "nauvis" {
+						t.Errorf("%s: got surface %q, want only nauvis", family.GetName(), label.GetValue())
+					}
+				}
+			}
+		}
+		if surfaces == 0 {
+			t.Error("got no metrics of nauvis")
+		}
+	}
+}
+
+func TestEnemyEntities(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {
+		"nauvis": {"entities": {
+			"player": {"gun-turret": 20},
+			"enemy": {"biter-spawner": 7, "spitter-spawner": 3, "medium-worm-turret": {"normal": 4, "rare": 1}}
+		}},
+		"vulcanus": {"entities": {"enemy": {"small-demolisher": 1}}}
+	}}`)
+
+	expected := `
+# HELP factorio_enemy_entity_count The number of enemy entities, such as spawners, worms and units (count).
+# TYPE factorio_enemy_entity_count gauge
+factorio_enemy_entity_count{name="biter-spawner",surface="nauvis"} 7
+factorio_enemy_entity_count{name="medium-worm-turret",surface="nauvis"} 5
+factorio_enemy_entity_count{name="spitter-spawner",surface="nauvis"} 3
+factorio_enemy_entity_count{name="small-demolisher",surface="vulcanus"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_enemy_entity_count"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEntityFilter(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {"nauvis": {"entities": {
+		"nuclear-reactor": 4, "roboport": 12, "beacon": 80, "se-beacon-overload": 2, "transport-belt": 3000
+	}}}}`)
+	collector.EntityInclude = regexp.MustCompile(`^(nuclear-reactor|roboport)$|beacon`)
+	collector.EntityExclude = regexp.MustCompile(`^se-`)
+
+	expected := `
+# HELP factorio_entity_count The total number of entities (count).
+# TYPE factorio_entity_count gauge
+factorio_entity_count{force="player",name="beacon",surface="nauvis"} 80
+factorio_entity_count{force="player",name="nuclear-reactor",surface="nauvis"} 4
+factorio_entity_count{force="player",name="roboport",surface="nauvis"} 12
+# HELP factorio_surface_entity_total The number of entities on a surface across all prototypes and forces (count).
+# TYPE factorio_surface_entity_total gauge
+factorio_surface_entity_total{surface="nauvis"} 3098
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_entity_count", "factorio_surface_entity_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSurfaceEntityTotal(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {
+		"nauvis": {"entities": {"stone-furnace": 2, "assembling-machine-3": {"normal": 4, "rare": 1}, "enemy": {"small-biter": 10}}},
+		"vulcanus": {"entities": {}}
+	}}`)
+
+	expected := `
+# HELP factorio_surface_entity_total The number of entities on a surface across all prototypes and forces (count).
+# TYPE factorio_surface_entity_total gauge
+factorio_surface_entity_total{surface="nauvis"} 17
+factorio_surface_entity_total{surface="vulcanus"} 0
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_surface_entity_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPollutionLabels(t *testing.T) {
+	// Sources named like surfaces or label names must stay in the source label.
+	collector := newTestCollector(t, `{
+		"pollution": {"nauvis": {"nauvis": 1, "surface": 2, "boiler": {"production": 10, "consumption": 4}, "tree-01": -3}},
+		"surfaces": {"nauvis": {"pollution": 9}}
+	}`)
+
+	expected := `
+# HELP factorio_surface_pollution_absorbed The pollution absorbed by a source, as a positive amount (pollution units).
+# TYPE factorio_surface_pollution_absorbed gauge
+factorio_surface_pollution_absorbed{pollutant="pollution",source="boiler",surface="nauvis"} 4
+factorio_surface_pollution_absorbed{pollutant="pollution",source="tree-01",surface="nauvis"} 3
+# HELP factorio_surface_pollution_emitted The pollution emitted by a source (pollution units).
+# TYPE factorio_surface_pollution_emitted gauge
+factorio_surface_pollution_emitted{pollutant="pollution",source="boiler",surface="nauvis"} 10
+factorio_surface_pollution_emitted{pollutant="pollution",source="nauvis",surface="nauvis"} 1
+factorio_surface_pollution_emitted{pollutant="pollution",source="surface",surface="nauvis"} 2
+# HELP factorio_surface_pollution_production The pollution produced or consumed from various sources (pollution units).
+# TYPE factorio_surface_pollution_production gauge
+factorio_surface_pollution_production{pollutant="pollution",source="boiler",surface="nauvis"} 6
+factorio_surface_pollution_production{pollutant="pollution",source="nauvis",surface="nauvis"} 1
+factorio_surface_pollution_production{pollutant="pollution",source="surface",surface="nauvis"} 2
+factorio_surface_pollution_production{pollutant="pollution",source="tree-01",surface="nauvis"} -3
+# HELP factorio_surface_pollution_total The total pollution on a given surface (pollution units).
+# TYPE factorio_surface_pollution_total gauge
+factorio_surface_pollution_total{pollutant="pollution",surface="nauvis"} 9
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"factorio_surface_pollution_production", "factorio_surface_pollution_emitted", "factorio_surface_pollution_absorbed", "factorio_surface_pollution_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPollutants(t *testing.T) {
+	collector := newTestCollector(t, `{
+		"pollution": {"gleba": {
+			"agricultural-tower": {"spores": 8},
+			"biochamber": {"pollution": {"production": 5, "consumption": 0}, "spores": 2},
+			"tree-01": {"spores": -3}
+		}},
+		"surfaces": {"gleba": {"pollution": {"pollution": 4, "spores": 120}}, "nauvis": {"pollution": 9}}
+	}`)
+
+	expected := `
+# HELP factorio_surface_pollution_production The pollution produced or consumed from various sources (pollution units).
+# TYPE factorio_surface_pollution_production gauge
+factorio_surface_pollution_production{pollutant="spores",source="agricultural-tower",surface="gleba"} 8
+factorio_surface_pollution_production{pollutant="pollution",source="biochamber",surface="gleba"} 5
+factorio_surface_pollution_production{pollutant="spores",source="biochamber",surface="gleba"} 2
+factorio_surface_pollution_production{pollutant="spores",source="tree-01",surface="gleba"} -3
+# HELP factorio_surface_pollution_total The total pollution on a given surface (pollution units).
+# TYPE factorio_surface_pollution_total gauge
+factorio_surface_pollution_total{pollutant="pollution",surface="gleba"} 4
+factorio_surface_pollution_total{pollutant="spores",surface="gleba"} 120
+factorio_surface_pollution_total{pollutant="pollution",surface="nauvis"} 9
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"factorio_surface_pollution_production", "factorio_surface_pollution_total")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEntityForces(t *testing.T) {
+	tests := []struct {
+		fixture      string
+		defaultForce string
+		expected     string
+	}{
+		{
+			fixture:      "testdata/entities_flat.json",
+			defaultForce: "default",
+			expected: `
+# HELP factorio_entity_count The total number of entities (count).
+# TYPE factorio_entity_count gauge
+factorio_entity_count{force="default",name="assembling-machine-2",surface="nauvis"} 4
+factorio_entity_count{force="default",name="stone-furnace",surface="nauvis"} 12
+`,
+		},
+		{
+			// Without a default force, flat counts are surface-wide.
+			fixture: "testdata/entities_flat.json",
+			expected: `
+# HELP factorio_entity_count The total number of entities (count).
+# TYPE factorio_entity_count gauge
+factorio_entity_count{force="",name="assembling-machine-2",surface="nauvis"} 4
+factorio_entity_count{force="",name="stone-furnace",surface="nauvis"} 12
+`,
+		},
+		{
+			fixture:      "testdata/entities_by_force.json",
+			defaultForce: "default",
+			expected: `
+# HELP factorio_entity_count The total number of entities (count).
+# TYPE factorio_entity_count gauge
+factorio_entity_count{force="custom-force",name="assembling-machine-3",surface="nauvis"} 3
+factorio_entity_count{force="enemy",name="biter-spawner",surface="nauvis"} 7
+factorio_entity_count{force="team-north",name="assembling-machine-2",surface="nauvis"} 4
+factorio_entity_count{force="team-north",name="stone-furnace",surface="nauvis"} 12
+factorio_entity_count{force="team-south",name="stone-furnace",surface="nauvis"} 3
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture+"/"+tt.defaultForce, func(t *testing.T) {
+			collector := &Collector{MetricsPath: tt.fixture, DefaultForce: tt.defaultForce}
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(tt.expected), "factorio_entity_count"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// helpUnitPattern matches help strings ending with a parenthesized unit.
+var helpUnitPattern = regexp.MustCompile(`\([^()]+\)\.$`)
+
+func TestHelpEndsWithUnit(t *testing.T) {
+	collector := newTestCollector(t, `{
+		"game": {"time": {"tick": 60, "paused": true}, "save_load_count": 1},
+		"players": {"alice": {"connected": true}},
+		"forces": {"player": {
+			"research": {"progress": 0.5, "current": "automation", "queue": ["automation", "logistics"]},
+			"evolution_factor": 0.1,
+			"pollution_produced": 100,
+			"crafts": {"manual": 1, "machine": 2},
+			"items": {"nauvis": {"iron-plate": {"production": 1, "consumption": 1}}},
+			"rockets": {"launches": 1, "items": {"satellite": 1}},
+			"logistic_networks": {"nauvis": {"1": {"contents": {"iron-plate": 1}, "robots": {"construction": {"available": 1, "total": 1}}}}}
+		}},
+		"pollution": {"nauvis": {"boiler": 1}},
+		"surfaces": {"nauvis": {
+			"pollution": 1,
+			"ticks_per_day": 25000,
+			"daytime": 0.5,
+			"darkness": 0.85,
+			"radars": {"player": 1},
+			"artillery": {"player": 1},
+			"update_cost_ms": 1,
+			"enemy_groups": 1,
+			"enemy_chunks": 1,
+			"next_attack_estimate_ticks": 1,
+			"lamps": {"on": 1},
+			"rail_signals": {"open": 1},
+			"trains": 1,
+			"train_states": {"no_path": 1},
+			"electric_networks": {"1": {"production": {"steam-engine": 900000}, "consumption": {"lab": 60000}}},
+			"entities": {"stone-furnace": 1},
+			"entity_status": {"stone-furnace": {"no_power": 1}},
+			"recipes": {"iron-gear-wheel": {"machines": 1}}
+		}}
+	}`)
+	collector.ReportUnknownKeys = true
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if !helpUnitPattern.MatchString(family.GetHelp()) {
+			t.Errorf("%s: help %q does not end with a unit", family.GetName(), family.GetHelp())
+		}
+	}
+}
+
+func TestTrainNetworks(t *testing.T) {
+	tests := []struct {
+		fixture       string
+		trainNetworks bool
+		expected      string
+	}{
+		{
+			fixture: "testdata/trains_by_surface.json",
+			expected: `
+factorio_trains_total{surface="nauvis"} 14
+`,
+		},
+		{
+			fixture:       "testdata/trains_by_surface.json",
+			trainNetworks: true,
+			expected: `
+factorio_trains_total{network="",surface="nauvis"} 14
+`,
+		},
+		{
+			fixture: "testdata/trains_by_network.json",
+			expected: `
+factorio_trains_total{surface="nauvis"} 14
+`,
+		},
+		{
+			fixture:       "testdata/trains_by_network.json",
+			trainNetworks: true,
+			expected: `
+factorio_trains_total{network="1",surface="nauvis"} 10
+factorio_trains_total{network="7",surface="nauvis"} 4
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/networks=%v", tt.fixture, tt.trainNetworks), func(t *testing.T) {
+			collector := &Collector{MetricsPath: tt.fixture, TrainNetworks: tt.trainNetworks}
+			expected := `
+# HELP factorio_trains_total The number of trains on a given surface (count).
+# TYPE factorio_trains_total gauge` + tt.expected
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_trains_total"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestTrainStates(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {"nauvis": {"trains": 5, "train_states": {"on_the_path": 3, "no_path": 2}}}}`)
+
+	expected := `
+# HELP factorio_trains_by_state The number of trains in a given state on a given surface (count).
+# TYPE factorio_trains_by_state gauge
+factorio_trains_by_state{state="no_path",surface="nauvis"} 2
+factorio_trains_by_state{state="on_the_path",surface="nauvis"} 3
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_trains_by_state"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScrapeErrors(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 1}}}`)
+	// Register once, as Describe reads the metrics data as well.
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	scrape := func(up, errors int) {
+		t.Helper()
+		expected := fmt.Sprintf(`
+# HELP factorio_exporter_scrape_errors_total The number of failed reads of the metrics data (count).
+# TYPE factorio_exporter_scrape_errors_total counter
+factorio_exporter_scrape_errors_total %d
+# HELP factorio_up Whether the last read of the metrics data succeeded (boolean).
+# TYPE factorio_up gauge
+factorio_up %d
+`, errors, up)
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_up", "factorio_exporter_scrape_errors_total"); err != nil {
+			t.Error(err)
+		}
+	}
+
+	scrape(1, 0)
+	if err := os.WriteFile(collector.MetricsPath, []byte(`{"game": {"time": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	scrape(0, 1)
+	if err := os.Remove(collector.MetricsPath); err != nil {
+		t.Fatal(err)
+	}
+	scrape(0, 2)
+}
+
+func TestDisabledCollectors(t *testing.T) {
+	collector := newTestCollector(t, `{
+		"surfaces": {"nauvis": {"pollution": 5, "entities": {"stone-furnace": 12}}}
+	}`)
+	collector.DisabledCollectors = map[string]bool{"entities": true}
+
+	if count := testutil.CollectAndCount(collector, "factorio_entity_count"); count != 0 {
+		t.Errorf("got %d entity series with the entities collector disabled, want 0", count)
+	}
+	if count := testutil.CollectAndCount(collector, "factorio_surface_pollution_total"); count != 1 {
+		t.Errorf("got %d surface pollution series, want 1", count)
+	}
+}
+
+func TestCollectDuration(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 60}}}`)
+	collector.DisabledCollectors = map[string]bool{"entities": true}
+
+	// entities is disabled, and recipes is enabled by newTestCollector.
+	want := len(CollectorNames())
+	if count := testutil.CollectAndCount(collector, "factorio_exporter_collector_duration_seconds"); count != want {
+		t.Errorf("got %d collector durations, want %d", count, want)
+	}
+	if count := testutil.CollectAndCount(collector, "factorio_exporter_collect_duration_seconds"); count != 1 {
+		t.Errorf("got %d collect durations, want 1", count)
+	}
+
+	// The game tick, pause state, pause duration and players online.
+	expected := `
+# HELP factorio_exporter_collected_samples_total The number of samples emitted by the last collection (count).
+# TYPE factorio_exporter_collected_samples_total gauge
+factorio_exporter_collected_samples_total 4
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_exporter_collected_samples_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchemaMismatch(t *testing.T) {
+	tests := []struct {
+		json     string
+		expected string
+	}{
+		{json: `{}`},
+		{json: fmt.Sprintf(`{"schema_version": %d}`, SchemaVersion), expected: "factorio_metrics_schema_mismatch 0\n"},
+		{json: fmt.Sprintf(`{"schema_version": %d}`, SchemaVersion+1), expected: "factorio_metrics_schema_mismatch 1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			collector := newTestCollector(t, tt.json)
+			expected := ""
+			if tt.expected != "" {
+				expected = `
+# HELP factorio_metrics_schema_mismatch Whether the schema version of the metrics data differs from the one the exporter is built for (boolean).
+# TYPE factorio_metrics_schema_mismatch gauge
+` + tt.expected
+			}
+			if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_metrics_schema_mismatch"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestParseMetricsData(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr bool
+	}{
+		{name: "object", json: `{"forces": {"player": {"research": {"progress": 0.5}}}}`},
+		{name: "empty tables as arrays", json: `{"players": [], "forces": {"player": {"items": [], "research": []}}}`},
+		{name: "empty document as array", json: `[]`, wantErr: true},
+		{name: "empty object", json: `{}`, wantErr: true},
+		{name: "null", json: `null`, wantErr: true},
+		{name: "empty file", json: ``, wantErr: true},
+		{name: "number", json: `42`, wantErr: true},
+		{name: "unknown keys", json: `{"mystery": [1, {"a": "b"}], "game": {"time": {"tick": 1}}}`},
+		{name: "string tick", json: `{"game": {"time": {"tick": "1"}, "ups": 60}}`},
+		{name: "array of players", json: `{"players": ["alice"], "game": {}}`},
+		{name: "truncated", json: `{"game": {"time": `, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseMetricsData([]byte(tt.json), 0)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMistypedValues(t *testing.T) {
+	collector := newTestCollector(t, `{
+		"game": {"time": {"tick": 60, "paused": "no"}},
+		"players": {"alice": {"connected": true, "surface": 1}},
+		"forces": {"player": {
+			"items": {"nauvis": {"iron-plate": {"production": "lots"}, "copper-plate": {"production": 5}}},
+			"kills": {"biter": [1]}
+		}}
+	}`)
+
+	// The mistyped values are missing or zero, while the rest of the
+	// document is still collected.
+	expected := `
+# HELP factorio_force_prototype_production The total production of a given prototype for a force, including zero; prototypes without a recorded value are omitted (items or fluid units).
+# TYPE factorio_force_prototype_production counter
+factorio_force_prototype_production{force="player",prototype="copper-plate",surface="nauvis",type="items"} 5
+# HELP factorio_game_tick The current tick of the running Factorio game (ticks).
+# TYPE factorio_game_tick counter
+factorio_game_tick 60
+# HELP factorio_player_connected The current connection state of the player (boolean).
+# TYPE factorio_player_connected gauge
+factorio_player_connected{username="alice"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_force_prototype_production", "factorio_game_tick", "factorio_player_connected"); err != nil {
+		t.Error(err)
+	}
+
+	want := []string{
+		"game.time.paused",
+		"players.alice.surface",
+		"forces.player.items.nauvis.iron-plate.production",
+		"forces.player.kills.biter",
+	}
+	if !reflect.DeepEqual(collector.data.mistyped, want) {
+		t.Errorf("got mistyped values %q, want %q", collector.data.mistyped, want)
+	}
+}
+
+func TestReadRetry(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": `)
+	done := make(chan error)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		done <- os.WriteFile(collector.MetricsPath, []byte(`{"game": {"time": {"tick": 5}}}`), 0o644)
+	}()
+
+	if err := collector.Healthy(); err != nil {
+		t.Errorf("got error %v, want the read to be retried until the file is complete", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeLastData(t *testing.T) {
+	delays := readRetryDelays
+	readRetryDelays = nil
+	t.Cleanup(func() { readRetryDelays = delays })
+
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 60}}}`)
+	collector.ServeLastData = true
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	steps := []struct {
+		json     string
+		expected string
+	}{
+		{
+			json: `{"game": {"time": {"tick": 60}}}`,
+			expected: `
+# HELP factorio_game_tick The current tick of the running Factorio game (ticks).
+# TYPE factorio_game_tick counter
+factorio_game_tick 60
+# HELP factorio_metrics_data_stale Whether the metrics are from earlier data because the current data could not be parsed (boolean).
+# TYPE factorio_metrics_data_stale gauge
+factorio_metrics_data_stale 0
+# HELP factorio_up Whether the last read of the metrics data succeeded (boolean).
+# TYPE factorio_up gauge
+factorio_up 1
+`,
+		},
+		{
+			json: `{"game": {"time": {"tick": 1`,
+			expected: `
+# HELP factorio_game_tick The current tick of the running Factorio game (ticks).
+# TYPE factorio_game_tick counter
+factorio_game_tick 60
+# HELP factorio_metrics_data_stale Whether the metrics are from earlier data because the current data could not be parsed (boolean).
+# TYPE factorio_metrics_data_stale gauge
+factorio_metrics_data_stale 1
+# HELP factorio_up Whether the last read of the metrics data succeeded (boolean).
+# TYPE factorio_up gauge
+factorio_up 0
+`,
+		},
+	}
+	for i, step := range steps {
+		if err := os.WriteFile(collector.MetricsPath, []byte(step.json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(step.expected), "factorio_game_tick", "factorio_metrics_data_stale", "factorio_up"); err != nil {
+			t.Errorf("step %d: %v", i, err)
+		}
+	}
+
+	// A missing file is not taken for a write in progress.
+	if err := os.Remove(collector.MetricsPath); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := testutil.GatherAndCount(registry, "factorio_game_tick"); err != nil || count != 0 {
+		t.Errorf("got %d metrics without a metrics file, want 0 (error %v)", count, err)
+	}
+}
+
+func TestCounterResets(t *testing.T) {
+	collector := newTestCollector(t, `{"forces": {"player": {"rockets": {"launches": 50}}}}`)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	// An older save with fewer launches is loaded.
+	if err := os.WriteFile(collector.MetricsPath, []byte(`{"forces": {"player": {"rockets": {"launches": 3}}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP factorio_counter_reset_total The number of times a series of a counter decreased between collections (count).
+# TYPE factorio_counter_reset_total counter
+factorio_counter_reset_total{metric="factorio_rockets_launched"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_counter_reset_total"); err != nil {
+		t.Error(err)
+	}
+	// Unchanged counters do not count as another reset.
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_counter_reset_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLastLaunchTick(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 100}}, "forces": {
+		"player": {"rockets": {"launches": 1}},
+		"modded": {"rockets": {"launches": 1, "last_launch_tick": 42}}
+	}}`)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	expected := `
+# HELP factorio_last_rocket_launch_tick The game tick of the last rocket launch of a force (ticks).
+# TYPE factorio_last_rocket_launch_tick gauge
+factorio_last_rocket_launch_tick{force="modded"} 42
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_last_rocket_launch_tick"); err != nil {
+		t.Error(err)
+	}
+
+	if err := os.WriteFile(collector.MetricsPath, []byte(`{"game": {"time": {"tick": 2000}}, "forces": {
+		"player": {"rockets": {"launches": 2}},
+		"modded": {"rockets": {"launches": 1, "last_launch_tick": 42}}
+	}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expected += `factorio_last_rocket_launch_tick{force="player"} 2000
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_last_rocket_launch_tick"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUPS(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 60}, "ups": 59.5}}`)
+	registry := prometheus.NewRegistry()
+	modTime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(collector.MetricsPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	registry.MustRegister(collector)
+
+	// 60 ticks pass in 2 seconds of the file's modification time.
+	if err := os.WriteFile(collector.MetricsPath, []byte(`{"game": {"time": {"tick": 120}, "ups": 30.25}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	modTime = modTime.Add(2 * time.Second)
+	if err := os.Chtimes(collector.MetricsPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP factorio_game_ups The game updates per second reported by the mod (updates per second).
+# TYPE factorio_game_ups gauge
+factorio_game_ups 30.25
+# HELP factorio_game_ups_estimated The game updates per second estimated from the progress of the game tick (updates per second).
+# TYPE factorio_game_ups_estimated gauge
+factorio_game_ups_estimated 30
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_game_ups", "factorio_game_ups_estimated"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSurfaceClock(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {"nauvis": {"ticks_per_day": 25000, "daytime": 0.5}, "vulcanus": {"daytime": 0.125}, "space": {}}}`)
+	if count := testutil.CollectAndCount(collector, "factorio_surface_clock_info"); count != 0 {
+		t.Errorf("got %d metrics with the clock disabled, want 0", count)
+	}
+
+	collector.SurfaceClock = true
+	expected := `
+# HELP factorio_surface_clock_info The time of day on a given surface as a 24-hour clock, always 1 (info).
+# TYPE factorio_surface_clock_info gauge
+factorio_surface_clock_info{hhmm="00:00",surface="nauvis"} 1
+factorio_surface_clock_info{hhmm="15:00",surface="vulcanus"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_surface_clock_info"); err != nil {
+		t.Error(err)
+	}
+
+	for daytime, want := range map[float64]string{0: "12:00", 0.25: "18:00", 0.75: "06:00", 0.999999: "11:59", 1: "12:00"} {
+		if got := clockTime(daytime); got != want {
+			t.Errorf("clockTime(%v) = %s, want %s", daytime, got, want)
+		}
+	}
+}
+
+func TestResearchRate(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 3600}}, "forces": {"player": {"research": {
+		"current": "automation", "progress": 0.125, "science_per_minute": {"automation-science-pack": 30}
+	}}}}`)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	if count, err := testutil.GatherAndCount(registry, "factorio_force_research_progress_rate"); err != nil || count != 0 {
+		t.Errorf("got %d metrics from the first sample, want 0 (error %v)", count, err)
+	}
+
+	steps := []struct {
+		json     string
+		expected string
+	}{
+		{
+			json: `{"game": {"time": {"tick": 10800}}, "forces": {"player": {"research": {
+				"current": "automation", "progress": 0.375, "science_per_minute": {"automation-science-pack": 30}
+			}}}}`,
+			expected: `
+# HELP factorio_force_research_progress_rate The change of the research progress for a force (ratio per minute).
+# TYPE factorio_force_research_progress_rate gauge
+factorio_force_research_progress_rate{force="player"} 0.125
+# HELP factorio_force_science_per_minute The rate the labs of a force consume science packs at (packs per minute).
+# TYPE factorio_force_science_per_minute gauge
+factorio_force_science_per_minute{force="player",pack="automation-science-pack"} 30
+`,
+		},
+		{
+			// A new technology starts over, even with a higher progress.
+			json: `{"game": {"time": {"tick": 14400}}, "forces": {"player": {"research": {"current": "logistics", "progress": 0.5}}}}`,
+		},
+	}
+	for i, step := range steps {
+		if err := os.WriteFile(collector.MetricsPath, []byte(step.json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(step.expected), "factorio_force_research_progress_rate", "factorio_force_science_per_minute"); err != nil {
+			t.Errorf("step %d: %v", i, err)
+		}
+	}
+}
+
+func TestMinReadInterval(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 60}}}`)
+	collector.MinReadInterval = time.Hour
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+
+	if err := os.WriteFile(collector.MetricsPath, []byte(`{"game": {"time": {"tick": 120}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP factorio_game_tick The current tick of the running Factorio game (ticks).
+# TYPE factorio_game_tick counter
+factorio_game_tick 60
+`
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_game_tick"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	collector.MinReadInterval = time.Nanosecond
+	expected = strings.Replace(expected, "factorio_game_tick 60", "factorio_game_tick 120", 1)
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_game_tick"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMetricsFileAge(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {}}`)
+	modTime := time.Unix(1700000000, 0)
+	if err := os.Chtimes(collector.MetricsPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+# HELP factorio_metrics_file_mtime_seconds The modification time of the metrics file as a unix timestamp (seconds).
+# TYPE factorio_metrics_file_mtime_seconds gauge
+factorio_metrics_file_mtime_seconds 1.7e+09
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_metrics_file_mtime_seconds"); err != nil {
+		t.Error(err)
+	}
+	if count := testutil.CollectAndCount(collector, "factorio_metrics_file_age_seconds"); count != 1 {
+		t.Errorf("got %d file age metrics, want 1", count)
+	}
+}
+
+func TestMetricsDataCache(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 1}}}`)
+	modTime := time.Unix(1700000000, 0)
+	rewrite := func(json string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(collector.MetricsPath, []byte(json), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(collector.MetricsPath, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tick := func() float64 {
+		t.Helper()
+		if err := collector.readMetricsData(); err != nil {
+			t.Fatal(err)
+		}
+		return orZero(collector.data.Game.Time.Tick)
+	}
+
+	rewrite(`{"game": {"time": {"tick": 1}}}`, modTime)
+	if got := tick(); got != 1 {
+		t.Errorf("got tick %v, want 1", got)
+	}
+	rewrite(`{"game": {"time": {"tick": 2}}}`, modTime)
+	if got := tick(); got != 1 {
+		t.Errorf("got tick %v from an unchanged file, want cached 1", got)
+	}
+	rewrite(`{"game": {"time": {"tick": 2}}}`, modTime.Add(time.Second))
+	if got := tick(); got != 2 {
+		t.Errorf("got tick %v after modification, want 2", got)
+	}
+}
+
+func TestElectricity(t *testing.T) {
+	// Both the top-level section and the per-surface networks are read.
+	collector := newTestCollector(t, `{
+		"electricity": {"nauvis": {"1": {"production": {"steam-engine": 1800000}, "consumption": {"lab": 60000}}}},
+		"surfaces": {"vulcanus": {"electric_networks": {"4": {"production": {"solar-panel": 42000}}}}}
+	}`)
+
+	expected := `
+# HELP factorio_electricity_consumption_watts The power consumed by the entities of a given prototype in an electric network (watts).
+# TYPE factorio_electricity_consumption_watts gauge
+factorio_electricity_consumption_watts{network_id="1",prototype="lab",surface="nauvis"} 60000
+# HELP factorio_electricity_production_watts The power produced by the entities of a given prototype in an electric network (watts).
+# TYPE factorio_electricity_production_watts gauge
+factorio_electricity_production_watts{network_id="1",prototype="steam-engine",surface="nauvis"} 1.8e+06
+factorio_electricity_production_watts{network_id="4",prototype="solar-panel",surface="vulcanus"} 42000
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_electricity_production_watts", "factorio_electricity_consumption_watts"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAccumulators(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {
+		"nauvis": {
+			"accumulators": {"energy": 2500000, "capacity": 10000000},
+			"electric_networks": {"3": {"accumulators": {"energy": 0, "capacity": 0}}}
+		}
+	}}`)
+
+	expected := `
+# HELP factorio_accumulator_charge_ratio The charge of accumulators relative to their capacity (ratio, 0-1).
+# TYPE factorio_accumulator_charge_ratio gauge
+factorio_accumulator_charge_ratio{network_id="",surface="nauvis"} 0.25
+# HELP factorio_accumulator_energy_joules The energy stored in accumulators (joules).
+# TYPE factorio_accumulator_energy_joules gauge
+factorio_accumulator_energy_joules{network_id="",surface="nauvis"} 2.5e+06
+factorio_accumulator_energy_joules{network_id="3",surface="nauvis"} 0
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_accumulator_charge_ratio", "factorio_accumulator_energy_joules"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestElectricitySatisfaction(t *testing.T) {
+	collector := newTestCollector(t, `{
+		"electricity": {"nauvis": {
+			"1": {"production": {"steam-engine": 1800000}, "consumption": {"lab": 600000, "assembling-machine-2": 600000}},
+			"2": {"production": {"solar-panel": 300000}, "consumption": {"radar": 600000}},
+			"3": {"production": {"solar-panel": 42000}},
+			"4": {"accumulators": {"energy": 0, "capacity": 0}}
+		}}
+	}`)
+
+	expected := `
+# HELP factorio_electricity_satisfaction_ratio The share of the power demand of an electric network that is met, as in the in-game power UI (ratio, 0-1).
+# TYPE factorio_electricity_satisfaction_ratio gauge
+factorio_electricity_satisfaction_ratio{network_id="1",surface="nauvis"} 1
+factorio_electricity_satisfaction_ratio{network_id="2",surface="nauvis"} 0.5
+factorio_electricity_satisfaction_ratio{network_id="3",surface="nauvis"} 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_electricity_satisfaction_ratio"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResources(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {"nauvis": {"resources": {"iron-ore": 1250000, "crude-oil": 300000}}}}`)
+
+	expected := `
+# HELP factorio_resource_amount The remaining amount of a resource on a given surface (resource units).
+# TYPE factorio_resource_amount gauge
+factorio_resource_amount{resource="crude-oil",surface="nauvis"} 300000
+factorio_resource_amount{resource="iron-ore",surface="nauvis"} 1.25e+06
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_resource_amount"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCircuitSignals(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {"nauvis": {"circuit_networks": {
+		"12": [
+			{"signal": {"name": "iron-plate"}, "count": 1200},
+			{"signal": {"type": "virtual", "name": "signal-A"}, "count": -1}
+		],
+		"13": []
+	}}}}`)
+
+	expected := `
+# HELP factorio_circuit_signal_value The value of a signal in a circuit network (signal units).
+# TYPE factorio_circuit_signal_value gauge
+factorio_circuit_signal_value{network_id="12",signal_name="iron-plate",signal_type="item",surface="nauvis"} 1200
+factorio_circuit_signal_value{network_id="12",signal_name="signal-A",signal_type="virtual",surface="nauvis"} -1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_circuit_signal_value"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLogisticNetworks(t *testing.T) {
+	collector := newTestCollector(t, `{"forces": {"player": {"logistic_networks": {"nauvis": {"3": {
+		"contents": {"iron-plate": 1200, "construction-robot": 5},
+		"robots": {"construction": {"available": 2, "total": 40}, "logistic": {"total": 100}}
+	}}}}}}`)
+
+	expected := `
+# HELP factorio_logistic_bots_available The number of idle robots of a given type in a logistic network (count).
+# TYPE factorio_logistic_bots_available gauge
+factorio_logistic_bots_available{force="player",network_id="3",surface="nauvis",type="construction"} 2
+# HELP factorio_logistic_bots_total The number of robots of a given type in a logistic network (count).
+# TYPE factorio_logistic_bots_total gauge
+factorio_logistic_bots_total{force="player",network_id="3",surface="nauvis",type="construction"} 40
+factorio_logistic_bots_total{force="player",network_id="3",surface="nauvis",type="logistic"} 100
+# HELP factorio_logistic_network_item_count The number of items stored in a logistic network (items).
+# TYPE factorio_logistic_network_item_count gauge
+factorio_logistic_network_item_count{force="player",item="construction-robot",network_id="3",surface="nauvis"} 5
+factorio_logistic_network_item_count{force="player",item="iron-plate",network_id="3",surface="nauvis"} 1200
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"factorio_logistic_network_item_count", "factorio_logistic_bots_available", "factorio_logistic_bots_total"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGzipMetricsFile(t *testing.T) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	if _, err := writer.Write([]byte(`{"game": {"time": {"tick": 42}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "metrics.json.gz")
+	if err := os.WriteFile(path, compressed.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	collector := &Collector{MetricsPath: path}
+	expected := `
+# HELP factorio_game_tick The current tick of the running Factorio game (ticks).
+# TYPE factorio_game_tick counter
+factorio_game_tick 42
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_game_tick"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestNamespace(t *testing.T) {
+	collector := newTestCollector(t, `{"game": {"time": {"tick": 3}}}`)
+	collector.Namespace = "nauvis"
+
+	expected := `
+# HELP nauvis_game_tick The current tick of the running Factorio game (ticks).
+# TYPE nauvis_game_tick counter
+nauvis_game_tick 3
+# HELP nauvis_up Whether the last read of the metrics data succeeded (boolean).
+# TYPE nauvis_up gauge
+nauvis_up 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "nauvis_game_tick", "nauvis_up"); err != nil {
+		t.Error(err)
+	}
+	if count := testutil.CollectAndCount(collector, "factorio_game_tick"); count != 0 {
+		t.Errorf("got %d metrics with the factorio prefix, want 0", count)
+	}
+}
+
+// writeLargeMetricsFile writes a metrics file of a few megabytes with many
+// surfaces and entities.
+func writeLargeMetricsFile(b *testing.B) string {
+	b.Helper()
+	var json strings.Builder
+	json.WriteString(`{"game": {"time": {"tick": 1000}}, "surfaces": {`)
+	for surface := 0; surface < 100; surface++ {
+		if surface > 0 {
+			json.WriteString(",")
+		}
+		fmt.Fprintf(&json, `"surface-%d": {"pollution": 1.5, "entities": {`, surface)
+		for entity := 0; entity < 1000; entity++ {
+			if entity > 0 {
+				json.WriteString(",")
+			}
+			fmt.Fprintf(&json, `"entity-%d": {"normal": %d, "rare": 1}`, entity, entity)
+		}
+		json.WriteString("}}")
+	}
+	json.WriteString("}}")
+
+	path := filepath.Join(b.TempDir(), "metrics.json")
+	if err := os.WriteFile(path, []byte(json.String()), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// BenchmarkReadMetricsFile compares reading the whole file before parsing it,
+// as the collector used to, with parsing it while reading.
+func BenchmarkReadMetricsFile(b *testing.B) {
+	path := writeLargeMetricsFile(b)
+
+	b.Run("ReadFile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if !jsoniter.Valid(data) {
+				b.Fatal("invalid JSON")
+			}
+			jsoniter.Get(data)
+		}
+	})
+	b.Run("Stream", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := readWholeMetricsFile(path, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	collector := newTestCollector(t, `{"surfaces": {}, "mystery": 1, "game": {"time": {"tick": 1}}, "forces": []}`)
+	validation, err := collector.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Validation{
+		Sections: []string{"surfaces", "game", "forces"},
+		Missing:  []string{"players", "pollution"},
+		Unknown:  []string{"mystery"},
+	}
+	if !reflect.DeepEqual(validation, expected) {
+		t.Errorf("got %+v, want %+v", validation, expected)
+	}
+
+	if err := os.WriteFile(collector.MetricsPath, []byte(`{"game": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collector.Validate(); err == nil {
+		t.Error("got no error for a truncated file")
+	}
+}
+
+func TestStaleTimeout(t *testing.T) {
+	delays := readRetryDelays
+	readRetryDelays = nil
+	t.Cleanup(func() { readRetryDelays = delays })
+
+	for _, test := range []struct {
+		name    string
+		json    string
+		rewrite bool
+		stale   bool
+	}{
+		{"failing reads", `{`, true, true},
+		{"unchanged file", `{"game": {"time": {"tick": 42}}}`, false, true},
+		{"updated file", `{"game": {"time": {"tick": 42}}}`, true, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			collector := newTestCollector(t, test.json)
+			collector.StaleTimeout = 100 * time.Millisecond
+			stale := make(chan struct{}, 1)
+			collector.OnStale = func() { stale <- struct{}{} }
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			collector.Start(ctx)
+
+			deadline := time.After(500 * time.Millisecond)
+			for i := 0; ; i++ {
+				if test.rewrite {
+					// Growing the file changes its size, so that it counts as
+					// new data even if the modification time stays the same.
+					data := test.json + strings.Repeat(" ", i)
+					if err := os.WriteFile(collector.MetricsPath, []byte(data), 0o644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				testutil.CollectAndCount(collector, "factorio_up")
+				select {
+				case <-stale:
+					if !test.stale {
+						t.Fatal("OnStale was called despite new data")
+					}
+					return
+				case <-deadline:
+					if test.stale {
+						t.Fatal("OnStale was not called")
+					}
+					return
+				case <-time.After(20 * time.Millisecond):
+				}
+			}
+		})
+	}
+}
+
+func TestUnknownTopLevelKeys(t *testing.T) {
+	tests := []struct {
+		json     string
+		expected float64
+	}{
+		{`{"game": {"time": {"tick": 42}}, "players": {}}`, 0},
+		{`{"schema_version": 1, "game": {"time": {"tick": 42}}, "mods": {"space-age": "2.0.0"}, "version": "2.0.28"}`, 2},
+	}
+	for _, tt := range tests {
+		collector := newTestCollector(t, tt.json)
+		if count := testutil.CollectAndCount(collector, "factorio_exporter_unknown_top_level_keys"); count != 0 {
+			t.Errorf("%s: got %d series without ReportUnknownKeys, want none", tt.json, count)
+		}
+
+		collector.ReportUnknownKeys = true
+		expected := fmt.Sprintf(`
+# HELP factorio_exporter_unknown_top_level_keys The number of top-level keys in the JSON that the exporter does not consume (count).
+# TYPE factorio_exporter_unknown_top_level_keys gauge
+factorio_exporter_unknown_top_level_keys %g
+`, tt.expected)
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_exporter_unknown_top_level_keys"); err != nil {
+			t.Errorf("%s: %v", tt.json, err)
+		}
+	}
+}
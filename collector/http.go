@@ -0,0 +1,77 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// IsHTTPSource reports whether path refers to a metrics document served over
+// http or https.
+func IsHTTPSource(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// httpSource fetches the metrics document from a URL. The validators of the
+// last response are sent along with the next request, so that an unchanged
+// document is not downloaded again.
+type httpSource struct {
+	url      string
+	client   *http.Client
+	maxBytes int
+
+	etag         string
+	lastModified string
+}
+
+// newHTTPSource creates a source for an http:// or https:// URL. Requests time
+// out after timeout, unless it is zero, and documents larger than maxBytes are
+// rejected.
+func newHTTPSource(url string, timeout time.Duration, maxBytes int) *httpSource {
+	return &httpSource{url: url, client: &http.Client{Timeout: timeout}, maxBytes: maxBytes}
+}
+
+// fetch downloads and parses the metrics document. If cached is set and the
+// server reports the document as unchanged, data is nil. modTime is the
+// Last-Modified time of the document, or zero if the server sends none.
+func (s *httpSource) fetch(ctx context.Context, cached bool) (data *metricsData, modTime time.Time, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to fetch metrics data: %w", err)
+	}
+	if cached {
+		if s.etag != "" {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+		if s.lastModified != "" {
+			req.Header.Set("If-Modified-Since", s.lastModified)
+		}
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to fetch metrics data: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		modTime = lastModified
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		return nil, modTime, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, modTime, fmt.Errorf("failed to fetch metrics data: unexpected status %s", resp.Status)
+	}
+
+	// The body is limited before decompression and the document after it, so
+	// that neither a large download nor a small gzip bomb exhausts the memory.
+	data, err = parseMetricsReader(http.MaxBytesReader(nil, resp.Body, int64(s.maxBytes)), s.maxBytes)
+	if err != nil {
+		return nil, modTime, err
+	}
+	s.etag = resp.Header.Get("ETag")
+	s.lastModified = resp.Header.Get("Last-Modified")
+	return data, modTime, nil
+}
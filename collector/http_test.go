@@ -0,0 +1,134 @@
+package collector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHTTPSource(t *testing.T) {
+	modTime := time.Unix(1700000000, 0).UTC()
+	requests, downloads := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		downloads++
+		w.Write([]byte(`{"game": {"time": {"tick": 42}}}`))
+	}))
+	defer server.Close()
+
+	collector := NewFactorioCollector(server.URL + "/metrics.json")
+	expected := `
+# HELP factorio_game_tick The current tick of the running Factorio game (ticks).
+# TYPE factorio_game_tick counter
+factorio_game_tick 42
+# HELP factorio_metrics_file_mtime_seconds The modification time of the metrics file as a unix timestamp (seconds).
+# TYPE factorio_metrics_file_mtime_seconds gauge
+factorio_metrics_file_mtime_seconds 1.7e+09
+`
+	for range 2 {
+		if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_game_tick", "factorio_metrics_file_mtime_seconds"); err != nil {
+			t.Error(err)
+		}
+	}
+	if downloads != 1 || requests < 2 {
+		t.Errorf("got %d downloads in %d requests, want 1 download", downloads, requests)
+	}
+}
+
+func TestHTTPSourceErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large.json" {
+			w.Write([]byte(`{"game": {"time": {"tick": 42}}}`))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/missing.json", "/large.json"} {
+		collector := NewFactorioCollector(server.URL + path)
+		collector.MaxReadBytes = 8
+		if err := collector.Healthy(); err == nil {
+			t.Errorf("%s: got no error", path)
+		}
+	}
+}
+
+func TestHTTPSourceUPSWithoutModTime(t *testing.T) {
+	var tick atomic.Int64
+	tick.Store(60)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"game": {"time": {"tick": %d}}}`, tick.Load())
+	}))
+	defer server.Close()
+
+	collector := NewFactorioCollector(server.URL + "/metrics.json")
+	start := time.Now()
+	// Scrapes between updates of the data leave the estimate alone rather
+	// than reporting 0 ticks per second.
+	for range 2 {
+		if count := testutil.CollectAndCount(collector, "factorio_game_ups_estimated"); count != 0 {
+			t.Fatalf("got %d estimates of unchanged data, want none", count)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// The 60 ticks are timed from the first download, not the last scrape,
+	// so at least 200ms pass between the samples.
+	tick.Store(120)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start).Seconds()
+	for _, family := range families {
+		if family.GetName() != "factorio_game_ups_estimated" {
+			continue
+		}
+		ups := family.GetMetric()[0].GetGauge().GetValue()
+		if ups < 60/elapsed || ups > 60/0.2 {
+			t.Errorf("got an estimate of %g updates per second, want between %g and %g", ups, 60/elapsed, 60/0.2)
+		}
+		return
+	}
+	t.Error("got no estimate after the tick changed")
+}
+
+func TestHTTPSourceGzipLimit(t *testing.T) {
+	var body bytes.Buffer
+	compressed := gzip.NewWriter(&body)
+	fmt.Fprintf(compressed, `{"game": {"time": {"tick": 42}}, "padding": "%s"}`, strings.Repeat("x", 1<<20))
+	compressed.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body.Bytes())
+	}))
+	defer server.Close()
+
+	// The compressed body fits in the limit, but the document does not.
+	collector := NewFactorioCollector(server.URL + "/metrics.json.gz")
+	collector.MaxReadBytes = 64 << 10
+	if body.Len() > collector.MaxReadBytes {
+		t.Fatalf("compressed body of %d bytes exceeds the limit", body.Len())
+	}
+	err := collector.Healthy()
+	if err == nil || !strings.Contains(err.Error(), "exceeds 65536 bytes") {
+		t.Errorf("got error %v, want a size limit error", err)
+	}
+}
@@ -0,0 +1,90 @@
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	jsoniter "github.com/json-iterator/go"
+)
+
+// prototypeMetadata is the static metadata of a prototype.
+type prototypeMetadata struct {
+	Type        string `json:"type"`
+	DisplayName string `json:"display_name"`
+	Category    string `json:"category"`
+	StackSize   int    `json:"stack_size"`
+}
+
+// metadataFile is a JSON file mapping prototype names to their metadata. It is
+// reloaded whenever its modification time or size changes.
+type metadataFile struct {
+	path       string
+	modTime    time.Time
+	size       int64
+	prototypes map[string]prototypeMetadata
+}
+
+// load returns the current prototype metadata, reloading the file if it has
+// changed. A missing file yields no metadata.
+func (m *metadataFile) load() (map[string]prototypeMetadata, error) {
+	info, err := os.Stat(m.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		m.prototypes = nil
+		m.modTime = time.Time{}
+		return nil, nil
+	}
+	if err != nil {
+		return m.prototypes, fmt.Errorf("failed to stat metadata file: %w", err)
+	}
+	if m.prototypes != nil && info.ModTime().Equal(m.modTime) && info.Size() == m.size {
+		return m.prototypes, nil
+	}
+
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return m.prototypes, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+	var prototypes map[string]prototypeMetadata
+	if err := jsoniter.Unmarshal(data, &prototypes); err != nil {
+		return m.prototypes, fmt.Errorf("failed to parse metadata file: %w", err)
+	}
+	m.prototypes = prototypes
+	m.modTime = info.ModTime()
+	m.size = info.Size()
+	return m.prototypes, nil
+}
+
+func (c *Collector) collectPrototypeInfoMetrics(metrics *metricSet) {
+	prototypes, err := c.metadata.load()
+	if err != nil {
+		slog.Error("Error loading prototype metadata", "error", err)
+	}
+
+	names := make([]string, 0, len(prototypes))
+	for name := range prototypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		prototype := prototypes[name]
+		stackSize := ""
+		if prototype.StackSize > 0 {
+			stackSize = strconv.Itoa(prototype.StackSize)
+		}
+		metrics.gauge("factorio_prototype_info", "Static metadata of a prototype, always 1 (info).",
+			1,
+			"category", prototype.Category,
+			"display_name", prototype.DisplayName,
+			"prototype", name,
+			"stack_size", stackSize,
+			"type", prototype.Type,
+		)
+	}
+}
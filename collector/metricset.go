@@ -0,0 +1,216 @@
+package collector
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricSet accumulates the samples of a single collection before they are
+// sent to Prometheus. Label values are normalized if enabled and mapped through
+// the collector's label map. Samples that end up with the same name and label
+// values are summed if they are additive, and keep the largest value if not.
+type metricSet struct {
+	collector *Collector
+	descs     map[string]*prometheus.Desc
+	samples   map[string]*sample
+	keys      []string
+}
+
+// sample is a single value of a metric family.
+type sample struct {
+	name        string
+	desc        *prometheus.Desc
+	valueType   prometheus.ValueType
+	value       float64
+	additive    bool
+	labelValues []string
+}
+
+func (c *Collector) newMetricSet() *metricSet {
+	return &metricSet{
+		collector: c,
+		descs:     make(map[string]*prometheus.Desc),
+		samples:   make(map[string]*sample),
+	}
+}
+
+// gauge adds a gauge sample of an amount that adds up, such as a count.
+// labels are alternating label names and values.
+func (m *metricSet) gauge(name, help string, value float64, labels ...string) {
+	m.add(name, help, prometheus.GaugeValue, true, value, labels)
+}
+
+// nonAdditiveGauge adds a gauge sample whose values do not add up, such as a
+// boolean, a ratio, a tick or an info metric. labels are alternating label
+// names and values.
+func (m *metricSet) nonAdditiveGauge(name, help string, value float64, labels ...string) {
+	m.add(name, help, prometheus.GaugeValue, false, value, labels)
+}
+
+// counter adds a counter sample. labels are alternating label names and values.
+func (m *metricSet) counter(name, help string, value float64, labels ...string) {
+	m.add(name, help, prometheus.CounterValue, true, value, labels)
+}
+
+func (m *metricSet) add(name, help string, valueType prometheus.ValueType, additive bool, value float64, labels []string) {
+	if valueType == prometheus.CounterValue && m.collector.TotalSuffix && !strings.HasSuffix(name, "_total") {
+		name += "_total"
+	}
+	labelNames := make([]string, 0, len(labels)/2)
+	labelValues := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelNames = append(labelNames, labels[i])
+		labelValues = append(labelValues, m.collector.labelValue(labels[i], labels[i+1]))
+	}
+
+	key := name + "\xff" + strings.Join(labelValues, "\xff")
+	if existing, ok := m.samples[key]; ok {
+		if existing.additive {
+			existing.value += value
+		} else {
+			existing.value = max(existing.value, value)
+		}
+		return
+	}
+
+	desc, ok := m.descs[name]
+	if !ok {
+		desc = prometheus.NewDesc(MetricName(m.collector.Namespace, name), help, labelNames, nil)
+		m.descs[name] = desc
+	}
+	m.samples[key] = &sample{name: name, desc: desc, valueType: valueType, value: value, additive: additive, labelValues: labelValues}
+	m.keys = append(m.keys, key)
+}
+
+// labelValue returns the value to emit for a raw label value. Normalization
+// happens before mapping, so label map entries must use normalized values
+// when normalization is enabled.
+func (c *Collector) labelValue(name, value string) string {
+	if c.NormalizeLabels {
+		value = strings.ToLower(strings.TrimSpace(value))
+	}
+	return c.LabelMap.apply(name, value)
+}
+
+// emit sends all accumulated samples to ch and returns how many were sent. NaN
+// and infinite values are dropped, or zeroed if the collector is configured
+// to, since they usually stem from a malformed field rather than a real
+// reading.
+func (m *metricSet) emit(ch chan<- prometheus.Metric) int {
+	m.detectCounterResets()
+	sent := 0
+	for _, key := range m.keys {
+		s := m.samples[key]
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			slog.Debug("Non-finite sample", "desc", s.desc.String(), "labels", s.labelValues, "value", s.value)
+			if !m.collector.ZeroNonFinite {
+				continue
+			}
+			s.value = 0
+		}
+		if s.valueType == prometheus.CounterValue && strings.HasSuffix(s.name, "_total") {
+			ch <- m.collector.newCounterMetric(s.desc, s.value, s.labelValues...)
+		} else {
+			ch <- prometheus.MustNewConstMetric(s.desc, s.valueType, s.value, s.labelValues...)
+		}
+		sent++
+	}
+	return sent
+}
+
+// detectCounterResets compares the counters of the set with those of the
+// previous collection. Factorio's totals decrease when an older save is
+// loaded, which rate() takes for a counter reset, so decreases are logged and
+// counted per metric to explain dips in rates.
+func (m *metricSet) detectCounterResets() {
+	c := m.collector
+	counters := make(map[string]float64, len(c.counters))
+	resets := 0
+	for _, key := range m.keys {
+		s := m.samples[key]
+		if s.valueType != prometheus.CounterValue {
+			continue
+		}
+		if previous, ok := c.counters[key]; ok && s.value < previous {
+			if c.counterResets == nil {
+				c.counterResets = make(map[string]float64)
+			}
+			c.counterResets[MetricName(c.Namespace, s.name)]++
+			resets++
+		}
+		counters[key] = s.value
+	}
+	c.counters = counters
+	if resets > 0 {
+		slog.Warn("Counters decreased, an older save may have been loaded", "series", resets)
+	}
+	for name, count := range c.counterResets {
+		m.counter("factorio_counter_reset_total", "The number of times a series of a counter decreased between collections (count).",
+			count,
+			"metric", name,
+		)
+	}
+}
+
+// newCounterMetric creates a counter metric, attaching the current game tick as
+// an exemplar if exemplars are enabled. OpenMetrics only allows exemplars on
+// counters named *_total, and exposes other counters as unknown, so emit only
+// calls it for those; with TotalSuffix, that is every counter.
+func (c *Collector) newCounterMetric(desc *prometheus.Desc, value float64, labelValues ...string) prometheus.Metric {
+	metric := prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labelValues...)
+	if !c.Exemplars {
+		return metric
+	}
+	tick := c.data.Game.Time.Tick
+	if tick == nil {
+		return metric
+	}
+	withExemplar, err := prometheus.NewMetricWithExemplars(metric, prometheus.Exemplar{
+		Value:  value,
+		Labels: prometheus.Labels{"tick": strconv.FormatFloat(*tick, 'f', -1, 64)},
+	})
+	if err != nil {
+		slog.Debug("Failed to attach exemplar", "error", err)
+		return metric
+	}
+	return withExemplar
+}
+
+// LabelMap maps raw label values to display names, keyed by label name.
+// Values without a mapping are passed through unchanged. Mapping several raw
+// values of a label to the same display name sums their samples, or keeps the
+// largest value for samples that do not add up, such as booleans and ratios.
+type LabelMap map[string]map[string]string
+
+// LoadLabelMap reads a label map from a JSON file of the form
+// {"prototype": {"se-space-probe-mk1": "Space probe"}}. An empty path yields
+// an empty map.
+func LoadLabelMap(path string) (LabelMap, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read label map: %w", err)
+	}
+	var labels LabelMap
+	if err := jsoniter.Unmarshal(data, &labels); err != nil {
+		return nil, fmt.Errorf("failed to parse label map: %w", err)
+	}
+	return labels, nil
+}
+
+// apply returns the display name for the value of the given label.
+func (l LabelMap) apply(name, value string) string {
+	if mapped, ok := l[name][value]; ok {
+		return mapped
+	}
+	return value
+}
@@ -0,0 +1,74 @@
+//go:build unix
+
+package collector
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadTimeout(t *testing.T) {
+	// Opening a FIFO without a writer blocks, like a read from a stuck mount.
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := syscall.Mkfifo(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	collector := &Collector{MetricsPath: path, ReadTimeout: 50 * time.Millisecond}
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		err := collector.readMetricsData()
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("got error %v, want a timeout", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("read took %s despite the timeout", elapsed)
+		}
+	}
+
+	// Unblock the abandoned read, which is then picked up by the next read.
+	writer, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.WriteString(`{"game": {"time": {"tick": 7}}}`); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	collector.ReadTimeout = 5 * time.Second
+	if err := collector.readMetricsData(); err != nil {
+		t.Fatal(err)
+	}
+	if tick := orZero(collector.data.Game.Time.Tick); tick != 7 {
+		t.Errorf("got tick %v, want 7", tick)
+	}
+}
+
+func TestReadFIFOLimit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := syscall.Mkfifo(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		writer, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		defer writer.Close()
+		fmt.Fprintf(writer, `{"game": {"time": {"tick": 7}}, "padding": "%s"}`, strings.Repeat("x", 1<<20))
+	}()
+
+	// A FIFO has no size to check up front, so the read itself is limited,
+	// and exceeding the limit is not retried like a half-written file.
+	read := readMetricsFile(path, false, time.Time{}, 0, 64<<10)
+	var parseErr *parseError
+	if read.err == nil || !strings.Contains(read.err.Error(), "exceeds 65536 bytes") || errors.As(read.err, &parseErr) {
+		t.Errorf("got error %v, want a size limit error", read.err)
+	}
+}
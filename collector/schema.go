@@ -0,0 +1,448 @@
+package collector
+
+import (
+	"log/slog"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	jsoniter "github.com/json-iterator/go"
+	"github.com/modern-go/reflect2"
+)
+
+// SchemaVersion is the version of the metrics document the collector is built
+// for, as given by its top-level schema_version.
+const SchemaVersion = 1
+
+// metricsData is the metrics document written by the mod. Values that are
+// optional in the document are pointers, so that a missing value can be told
+// apart from zero. Values with several possible shapes are kept as jsoniter.Any
+// and interpreted by the collector.
+type metricsData struct {
+	SchemaVersion *float64                                  `json:"schema_version"`
+	Game          gameData                                  `json:"game"`
+	Players       map[string]playerData                     `json:"players"`
+	Forces        map[string]forceData                      `json:"forces"`
+	Pollution     map[string]map[string]jsoniter.Any        `json:"pollution"`
+	Surfaces      map[string]surfaceData                    `json:"surfaces"`
+	Electricity   map[string]map[string]electricNetworkData `json:"electricity"`
+
+	// keys are the top-level keys of the document in order, including those
+	// the collector does not consume.
+	keys []string
+	// mistyped are the paths of the values that were skipped for having an
+	// unexpected type.
+	mistyped []string
+}
+
+// topLevelFields returns the sections of d by their top-level key.
+func (d *metricsData) topLevelFields() map[string]any {
+	return map[string]any{
+		"schema_version": &d.SchemaVersion,
+		"game":           &d.Game,
+		"players":        &d.Players,
+		"forces":         &d.Forces,
+		"pollution":      &d.Pollution,
+		"surfaces":       &d.Surfaces,
+		"electricity":    &d.Electricity,
+	}
+}
+
+// keepSurfaces removes the sections of the surfaces include rejects. Cached
+// data is filtered again on every collection, which leaves it unchanged.
+func (d *metricsData) keepSurfaces(include func(string) bool) {
+	for surface_name := range d.Surfaces {
+		if !include(surface_name) {
+			delete(d.Surfaces, surface_name)
+		}
+	}
+	for surface_name := range d.Pollution {
+		if !include(surface_name) {
+			delete(d.Pollution, surface_name)
+		}
+	}
+	for surface_name := range d.Electricity {
+		if !include(surface_name) {
+			delete(d.Electricity, surface_name)
+		}
+	}
+	for _, force := range d.Forces {
+		for _, surfaces := range []map[string]map[string]flowData{force.Items, force.Fluids} {
+			for surface_name := range surfaces {
+				if !include(surface_name) {
+					delete(surfaces, surface_name)
+				}
+			}
+		}
+		for surface_name := range force.LogisticRequests {
+			if !include(surface_name) {
+				delete(force.LogisticRequests, surface_name)
+			}
+		}
+		for surface_name := range force.LogisticNetworks {
+			if !include(surface_name) {
+				delete(force.LogisticNetworks, surface_name)
+			}
+		}
+	}
+}
+
+// tick returns the current game tick, or 0 if the document has none.
+func (d *metricsData) tick() float64 {
+	return orZero(d.Game.Time.Tick)
+}
+
+type gameData struct {
+	Time struct {
+		Tick   *float64 `json:"tick"`
+		Paused bool     `json:"paused"`
+	} `json:"time"`
+	SaveLoadCount *float64 `json:"save_load_count"`
+	// UPS is the number of game updates per second measured by the mod.
+	UPS *float64 `json:"ups"`
+}
+
+type playerData struct {
+	Connected bool `json:"connected"`
+	// OnlineTime and AfkTime are in ticks, as reported by the game.
+	OnlineTime *float64 `json:"online_time"`
+	AfkTime    *float64 `json:"afk_time"`
+	Position   *struct {
+		X float64 `json:"x"`
+		Y float64 `json:"y"`
+	} `json:"position"`
+	Surface string `json:"surface"`
+	// Inventory holds the item counts of the main inventory.
+	Inventory map[string]float64 `json:"inventory"`
+}
+
+type forceData struct {
+	Research struct {
+		Progress float64  `json:"progress"`
+		Current  string   `json:"current"`
+		Queue    []string `json:"queue"`
+		// SciencePerMinute is the rate science packs are consumed at, by pack.
+		SciencePerMinute map[string]float64 `json:"science_per_minute"`
+	} `json:"research"`
+	// EvolutionFactor is a number, or an object with one factor per surface.
+	EvolutionFactor   jsoniter.Any `json:"evolution_factor"`
+	PollutionProduced *float64     `json:"pollution_produced"`
+	Crafts            struct {
+		Manual  *float64 `json:"manual"`
+		Machine *float64 `json:"machine"`
+	} `json:"crafts"`
+	// Kills counts the entities killed by the force per victim type, such as
+	// biter, spitter or player. Deaths counts the force's own losses.
+	Kills   map[string]float64             `json:"kills"`
+	Deaths  *float64                       `json:"deaths"`
+	Items   map[string]map[string]flowData `json:"items"`
+	Fluids  map[string]map[string]flowData `json:"fluids"`
+	Rockets struct {
+		Launches       *float64           `json:"launches"`
+		LastLaunchTick *float64           `json:"last_launch_tick"`
+		Items          map[string]float64 `json:"items"`
+	} `json:"rockets"`
+	LogisticRequests map[string]logisticRequestData            `json:"logistic_requests"`
+	LogisticNetworks map[string]map[string]logisticNetworkData `json:"logistic_networks"`
+}
+
+type flowData struct {
+	Production  *float64 `json:"production"`
+	Consumption *float64 `json:"consumption"`
+}
+
+type logisticRequestData struct {
+	Unfulfilled      *float64           `json:"unfulfilled"`
+	UnfulfilledItems map[string]float64 `json:"unfulfilled_items"`
+}
+
+type logisticNetworkData struct {
+	Contents map[string]float64 `json:"contents"`
+	Robots   map[string]struct {
+		Available *float64 `json:"available"`
+		Total     *float64 `json:"total"`
+	} `json:"robots"`
+}
+
+type surfaceData struct {
+	Pollution               jsoniter.Any       `json:"pollution"`
+	TicksPerDay             float64            `json:"ticks_per_day"`
+	Daytime                 *float64           `json:"daytime"`
+	Darkness                *float64           `json:"darkness"`
+	Radars                  map[string]float64 `json:"radars"`
+	Artillery               map[string]float64 `json:"artillery"`
+	UpdateCostMs            *float64           `json:"update_cost_ms"`
+	EnemyGroups             *float64           `json:"enemy_groups"`
+	EnemyChunks             *float64           `json:"enemy_chunks"`
+	NextAttackEstimateTicks *float64           `json:"next_attack_estimate_ticks"`
+	Lamps                   struct {
+		On *float64 `json:"on"`
+	} `json:"lamps"`
+	Chunks struct {
+		Generated *float64 `json:"generated"`
+		// Charted counts the chunks charted by any force.
+		Charted *float64 `json:"charted"`
+	} `json:"chunks"`
+	RailSignals map[string]float64 `json:"rail_signals"`
+	// Resources is the remaining amount of each resource, summed over all
+	// resource entities of the surface.
+	Resources map[string]float64 `json:"resources"`
+	// Entities maps entity names to counts or per-quality counts, or forces
+	// to such maps.
+	Entities     map[string]jsoniter.Any       `json:"entities"`
+	EntityStatus map[string]map[string]float64 `json:"entity_status"`
+	// Trains is a count, or an object of counts per rail network.
+	Trains           jsoniter.Any                   `json:"trains"`
+	TrainStates      map[string]float64             `json:"train_states"`
+	ElectricNetworks map[string]electricNetworkData `json:"electric_networks"`
+	// Accumulators sums the accumulators of all electric networks.
+	Accumulators *accumulatorData `json:"accumulators"`
+	// CircuitNetworks holds the signals of the exported circuit networks, in
+	// the format of LuaCircuitNetwork.signals.
+	CircuitNetworks map[string][]signalData `json:"circuit_networks"`
+	Recipes         map[string]struct {
+		Machines *float64 `json:"machines"`
+	} `json:"recipes"`
+}
+
+type signalData struct {
+	Signal struct {
+		// Type is empty for items.
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"signal"`
+	Count float64 `json:"count"`
+}
+
+type electricNetworkData struct {
+	Production   map[string]float64 `json:"production"`
+	Consumption  map[string]float64 `json:"consumption"`
+	Accumulators *accumulatorData   `json:"accumulators"`
+}
+
+// accumulatorData is the energy stored in accumulators along with how much
+// they can store, in joules.
+type accumulatorData struct {
+	Energy   float64 `json:"energy"`
+	Capacity float64 `json:"capacity"`
+}
+
+// orZero returns the value of an optional number, or 0 if it is missing.
+func orZero(v *float64) float64 {
+	if v == nil {
+		return 0
+	}
+	return *v
+}
+
+// metricsConfig decodes the metrics document. Lua serializes an empty table as
+// an empty array, so objects accept an empty array in their place. Other
+// values of an unexpected type are skipped and recorded in the decodeState of
+// the iterator, so that one mistyped field does not fail the whole document.
+var metricsConfig = func() jsoniter.API {
+	api := jsoniter.Config{}.Froze()
+	api.RegisterExtension(&metricsExtension{})
+	return api
+}()
+
+// decodeState is the attachment of the iterator the metrics document is
+// decoded with. It tracks the path of the value being decoded.
+type decodeState struct {
+	path []string
+	// mistyped are the paths of the values that were skipped for having an
+	// unexpected type.
+	mistyped []string
+}
+
+func (s *decodeState) push(name string) {
+	s.path = append(s.path, name)
+}
+
+func (s *decodeState) pop() {
+	s.path = s.path[:len(s.path)-1]
+}
+
+// recordMistyped records the path of the value being decoded as mistyped.
+func recordMistyped(iter *jsoniter.Iterator) {
+	if state, ok := iter.Attachment.(*decodeState); ok {
+		state.mistyped = append(state.mistyped, strings.Join(state.path, "."))
+	}
+}
+
+// skipMistyped skips the value at iter, recording its path as mistyped.
+func skipMistyped(iter *jsoniter.Iterator) {
+	recordMistyped(iter)
+	iter.Skip()
+}
+
+// decodeMetricsData decodes the metrics document from iter. The top-level keys
+// are walked one by one to record those the collector does not consume. Values
+// of the wrong type are skipped and logged with their path, so that changes in
+// the document show up in the log instead of as zero metrics, while the rest
+// of the document is still collected.
+func decodeMetricsData(iter *jsoniter.Iterator) *metricsData {
+	data := &metricsData{}
+	fields := data.topLevelFields()
+	if iter.WhatIsNext() == jsoniter.ArrayValue {
+		readEmptyArray(iter)
+		return data
+	}
+	state := &decodeState{}
+	iter.Attachment = state
+	iter.ReadObjectCB(func(iter *jsoniter.Iterator, key string) bool {
+		data.keys = append(data.keys, key)
+		if field, ok := fields[key]; ok {
+			state.push(key)
+			iter.ReadVal(field)
+			state.pop()
+		} else {
+			iter.Skip()
+		}
+		return iter.Error == nil
+	})
+	data.mistyped = state.mistyped
+	if len(data.mistyped) > 0 && iter.Error == nil {
+		slog.Warn("Skipped values of an unexpected type in the metrics data", "count", len(data.mistyped), "paths", data.mistyped[:min(len(data.mistyped), 10)])
+	}
+	return data
+}
+
+// readEmptyArray consumes an array from iter, reporting an error unless it is
+// empty.
+func readEmptyArray(iter *jsoniter.Iterator) {
+	if iter.ReadArray() {
+		iter.ReportError("decode metrics data", "expect an object or an empty array")
+	}
+}
+
+// metricsExtension checks the type of every value before decoding it and
+// tracks the path of the value being decoded, by struct field and map key.
+type metricsExtension struct {
+	jsoniter.DummyExtension
+}
+
+func (e *metricsExtension) UpdateStructDescriptor(desc *jsoniter.StructDescriptor) {
+	for _, binding := range desc.Fields {
+		if binding.Decoder != nil && len(binding.FromNames) > 0 {
+			binding.Decoder = fieldDecoder{name: binding.FromNames[0], decoder: binding.Decoder}
+		}
+	}
+}
+
+func (e *metricsExtension) CreateMapKeyDecoder(typ reflect2.Type) jsoniter.ValDecoder {
+	if typ.Kind() != reflect.String {
+		return nil
+	}
+	return mapKeyDecoder{}
+}
+
+func (e *metricsExtension) DecorateDecoder(typ reflect2.Type, decoder jsoniter.ValDecoder) jsoniter.ValDecoder {
+	kind := typ.Kind()
+	if kind == reflect.Map || kind == reflect.Struct {
+		return tableDecoder{decoder: decoder, isMap: kind == reflect.Map}
+	}
+	// Pointers are checked as well, so that a mistyped optional value stays
+	// missing rather than pointing to zero.
+	if kind == reflect.Ptr {
+		kind = typ.(reflect2.PtrType).Elem().Kind()
+	}
+	if valueType, ok := valueTypes[kind]; ok {
+		return typedDecoder{decoder: decoder, valueType: valueType}
+	}
+	return decoder
+}
+
+// valueTypes are the JSON value types of the leaf kinds of the metrics data.
+var valueTypes = map[reflect.Kind]jsoniter.ValueType{
+	reflect.Slice:   jsoniter.ArrayValue,
+	reflect.String:  jsoniter.StringValue,
+	reflect.Bool:    jsoniter.BoolValue,
+	reflect.Float64: jsoniter.NumberValue,
+}
+
+// fieldDecoder adds the name of a struct field to the path while decoding it.
+type fieldDecoder struct {
+	name    string
+	decoder jsoniter.ValDecoder
+}
+
+func (d fieldDecoder) Decode(ptr unsafe.Pointer, iter *jsoniter.Iterator) {
+	state, ok := iter.Attachment.(*decodeState)
+	if !ok {
+		d.decoder.Decode(ptr, iter)
+		return
+	}
+	state.push(d.name)
+	d.decoder.Decode(ptr, iter)
+	state.pop()
+}
+
+// mapKeyDecoder decodes a map key and makes it the last element of the path,
+// which the tableDecoder of the map reserved.
+type mapKeyDecoder struct{}
+
+func (mapKeyDecoder) Decode(ptr unsafe.Pointer, iter *jsoniter.Iterator) {
+	key := iter.ReadString()
+	*(*string)(ptr) = key
+	if state, ok := iter.Attachment.(*decodeState); ok && len(state.path) > 0 {
+		state.path[len(state.path)-1] = key
+	}
+}
+
+// typedDecoder decodes values of the given type, or null, and skips others.
+type typedDecoder struct {
+	decoder   jsoniter.ValDecoder
+	valueType jsoniter.ValueType
+}
+
+func (d typedDecoder) Decode(ptr unsafe.Pointer, iter *jsoniter.Iterator) {
+	switch next := iter.WhatIsNext(); next {
+	case d.valueType, jsoniter.NilValue, jsoniter.InvalidValue:
+		// Invalid values are left to the decoder to report, since they
+		// stem from truncated documents rather than unexpected types.
+		d.decoder.Decode(ptr, iter)
+	default:
+		skipMistyped(iter)
+	}
+}
+
+// tableDecoder decodes maps and structs from objects, or from an empty array
+// in their place, and skips other values.
+type tableDecoder struct {
+	decoder jsoniter.ValDecoder
+	isMap   bool
+}
+
+func (d tableDecoder) Decode(ptr unsafe.Pointer, iter *jsoniter.Iterator) {
+	switch iter.WhatIsNext() {
+	case jsoniter.ObjectValue, jsoniter.NilValue, jsoniter.InvalidValue:
+	case jsoniter.ArrayValue:
+		d.readEmptyTable(iter)
+		return
+	default:
+		skipMistyped(iter)
+		return
+	}
+	state, ok := iter.Attachment.(*decodeState)
+	if !ok || !d.isMap {
+		d.decoder.Decode(ptr, iter)
+		return
+	}
+	state.push("")
+	d.decoder.Decode(ptr, iter)
+	state.pop()
+}
+
+// readEmptyTable consumes an array in place of a table. Arrays with elements
+// are recorded as mistyped.
+func (d tableDecoder) readEmptyTable(iter *jsoniter.Iterator) {
+	empty := true
+	iter.ReadArrayCB(func(iter *jsoniter.Iterator) bool {
+		empty = false
+		iter.Skip()
+		return true
+	})
+	if !empty {
+		recordMistyped(iter)
+	}
+}
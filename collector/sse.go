@@ -0,0 +1,157 @@
+package collector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IsSSESource reports whether path refers to a Server-Sent Events stream.
+func IsSSESource(path string) bool {
+	return strings.HasPrefix(path, "sse://") || strings.HasPrefix(path, "sses://")
+}
+
+// sseStream keeps the data of the latest event of a Server-Sent Events stream
+// whose events each carry a complete metrics document.
+type sseStream struct {
+	url      string
+	client   *http.Client
+	maxBytes int
+	ready    chan struct{}
+
+	mutex     sync.Mutex
+	data      []byte
+	received  time.Time
+	connected bool
+}
+
+// newSSEStream creates a stream for an sse:// or sses:// source, which is
+// fetched over http or https respectively. Events larger than maxBytes drop
+// the connection.
+func newSSEStream(source string, maxBytes int) *sseStream {
+	url := strings.Replace(source, "sses://", "https://", 1)
+	url = strings.Replace(url, "sse://", "http://", 1)
+	return &sseStream{url: url, client: &http.Client{}, maxBytes: maxBytes, ready: make(chan struct{})}
+}
+
+// wait blocks until the first event has been received or ctx is done.
+func (s *sseStream) wait(ctx context.Context) error {
+	select {
+	case <-s.ready:
+		return nil
+	case <-ctx.Done():
+		return errors.New("no event received yet")
+	}
+}
+
+// latest returns the data of the most recent event and when it was received.
+// It fails while the stream is disconnected, so that stale data is not served.
+func (s *sseStream) latest() ([]byte, time.Time, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.connected {
+		return nil, time.Time{}, errors.New("event stream is disconnected")
+	}
+	if s.data == nil {
+		return nil, time.Time{}, errors.New("no event received yet")
+	}
+	return s.data, s.received, nil
+}
+
+// run reads events until ctx is done, reconnecting with exponential backoff
+// whenever the connection fails or drops.
+func (s *sseStream) run(ctx context.Context) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := s.connect(ctx)
+		s.setDisconnected()
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+		slog.Warn("Event stream disconnected", "url", s.url, "error", err, "retry_in", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// connect opens the stream and stores every event until the connection ends.
+func (s *sseStream) connect(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	slog.Info("Event stream connected", "url", s.url)
+	s.mutex.Lock()
+	s.connected = true
+	s.mutex.Unlock()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, min(64<<10, s.maxBytes)), s.maxBytes)
+	var event bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if event.Len()+len(line) > s.maxBytes {
+			return fmt.Errorf("event exceeds %d bytes", s.maxBytes)
+		}
+		switch {
+		case len(line) == 0:
+			if event.Len() > 0 {
+				s.setData(bytes.Clone(event.Bytes()))
+				event.Reset()
+			}
+		case bytes.HasPrefix(line, []byte("data:")):
+			if event.Len() > 0 {
+				event.WriteByte('\n')
+			}
+			event.Write(bytes.TrimPrefix(bytes.TrimPrefix(line, []byte("data:")), []byte(" ")))
+		}
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		return fmt.Errorf("event exceeds %d bytes", s.maxBytes)
+	} else if err != nil {
+		return err
+	}
+	return errors.New("stream closed by server")
+}
+
+func (s *sseStream) setData(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.data == nil {
+		close(s.ready)
+	}
+	s.data = data
+	s.received = time.Now()
+}
+
+func (s *sseStream) setDisconnected() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connected = false
+}
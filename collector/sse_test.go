@@ -0,0 +1,130 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSSEStream(t *testing.T) {
+	events := make(chan string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				fmt.Fprint(w, event)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer server.Close()
+
+	stream := newSSEStream(strings.Replace(server.URL, "http://", "sse://", 1), 1<<20)
+	if _, _, err := stream.latest(); err == nil {
+		t.Fatal("expected an error before connecting")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go stream.run(ctx)
+
+	events <- ": comment\nevent: metrics\ndata: {\"game\":\ndata: {}}\n\n"
+	waitFor(t, func() bool {
+		data, _, err := stream.latest()
+		return err == nil && string(data) == "{\"game\":\n{}}"
+	})
+
+	close(events)
+	waitFor(t, func() bool {
+		_, _, err := stream.latest()
+		return err != nil
+	})
+}
+
+func TestWaitReady(t *testing.T) {
+	events := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case event := <-events:
+			fmt.Fprint(w, event)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		}
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	collector := NewFactorioCollector(strings.Replace(server.URL, "http://", "sse://", 1))
+	collector.Start(ctx)
+
+	short, cancelShort := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancelShort()
+	if err := collector.WaitReady(short); err == nil {
+		t.Error("got no error before the first event")
+	}
+
+	events <- "data: {\"game\": {\"time\": {\"tick\": 42}}}\n\n"
+	if err := collector.WaitReady(ctx); err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+# HELP factorio_up Whether the last read of the metrics data succeeded (boolean).
+# TYPE factorio_up gauge
+factorio_up 1
+`
+	if err := testutil.CollectAndCompare(collector, strings.NewReader(expected), "factorio_up"); err != nil {
+		t.Error(err)
+	}
+
+	if err := NewFactorioCollector("metrics.json").WaitReady(short); err != nil {
+		t.Errorf("got %v for a file source, want no error", err)
+	}
+}
+
+// waitFor polls condition until it holds or a timeout expires.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSSEStreamMaxBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\ndata: %s\n\n", strings.Repeat("x", 60), strings.Repeat("x", 60))
+	}))
+	defer server.Close()
+
+	stream := newSSEStream(strings.Replace(server.URL, "http://", "sse://", 1), 100)
+	err := stream.connect(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "exceeds 100 bytes") {
+		t.Fatalf("got error %v, want a size limit error", err)
+	}
+	if _, _, err := stream.latest(); err == nil {
+		t.Error("expected no event to be stored")
+	}
+}
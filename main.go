@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/max-te/factorio-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v3"
+)
+
+var logLevel = new(slog.LevelVar)
+var log = slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel}))
+
+// newLogger creates a logger writing to w in the given format, either text or
+// json.
+func newLogger(w io.Writer, format string) (*slog.Logger, error) {
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
+}
+
+// shutdownTimeout bounds how long in-flight requests may take on shutdown.
+const shutdownTimeout = 5 * time.Second
+
+// labelNamePattern matches valid Prometheus label names.
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// namespacePattern matches valid metric namespaces.
+var namespacePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// labelsFlag is a repeatable flag of key=value label pairs.
+type labelsFlag prometheus.Labels
+
+func (l labelsFlag) String() string {
+	pairs := make([]string, 0, len(l))
+	for name, value := range l {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labelsFlag) Set(value string) error {
+	name, labelValue, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	if !labelNamePattern.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+	if slices.Contains(collector.LabelNames(), name) || slices.Contains(buildInfoLabelNames, name) {
+		return fmt.Errorf("label name %q is already used by the exporter's metrics", name)
+	}
+	if labelValue == "" || !utf8.ValidString(labelValue) {
+		return fmt.Errorf("invalid value for label %q", name)
+	}
+	l[name] = labelValue
+	return nil
+}
+
+var constLabels = labelsFlag{}
+
+func init() {
+	flag.Var(constLabels, "const-labels", "A key=value label to add to every metric, whose name the exporter's metrics must not use already (repeatable)")
+}
+
+// isLoopbackAddress reports whether a host:port listen address only accepts
+// connections from the local machine.
+func isLoopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// writeMetrics gathers the metrics of gatherer once and writes them to w in the
+// Prometheus text format.
+func writeMetrics(w io.Writer, gatherer prometheus.Gatherer) error {
+	families, err := gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	encoder := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			return fmt.Errorf("failed to encode metrics: %w", err)
+		}
+	}
+	return nil
+}
+
+// metricsHandler serves the metrics of gatherer, instrumented with the
+// promhttp metrics registered with registerer. With openMetrics, the
+// OpenMetrics format is negotiated through the Accept header, which is needed
+// for exemplars. Scrapers that do not ask for it get the text format.
+func metricsHandler(registerer prometheus.Registerer, gatherer prometheus.Gatherer, openMetrics bool) http.Handler {
+	return promhttp.InstrumentMetricHandler(
+		registerer,
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{EnableOpenMetrics: openMetrics}),
+	)
+}
+
+// version and commit identify the build of the exporter. They are set at build
+// time with -ldflags "-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+// buildInfoLabelNames are the labels of the build info gauge.
+var buildInfoLabelNames = []string{"commit", "goversion", "version"}
+
+// newBuildInfo returns a gauge describing the build of the exporter.
+func newBuildInfo(namespace string) prometheus.Gauge {
+	buildInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: collector.MetricName(namespace, "factorio_exporter_build_info"),
+		Help: "The version and commit of the exporter and the Go version it was built with, always 1 (info).",
+		ConstLabels: prometheus.Labels{
+			"commit":    commit,
+			"goversion": runtime.Version(),
+			"version":   version,
+		},
+	})
+	buildInfo.Set(1)
+	return buildInfo
+}
+
+// landingPage serves a page linking to the metrics at the root path, and 404
+// for any other path.
+func landingPage() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><title>Factorio Exporter</title></head>
+<body>
+<h1>Factorio Exporter</h1>
+<p>Version %s</p>
+<p><a href="/metrics">Metrics</a></p>
+</body>
+</html>
+`, html.EscapeString(version))
+	})
+}
+
+// healthHandler answers 200 if the metrics data of every collector can be read
+// and 503 otherwise, without collecting any metrics.
+func healthHandler(collectors []*collector.Collector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, c := range collectors {
+			// The endpoint is not behind basic auth, so the error is only logged.
+			if err := c.Healthy(); err != nil {
+				log.Debug("Health check failed", "error", err)
+				http.Error(w, "Metrics data unavailable", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "OK")
+	})
+}
+
+// basicAuth wraps next in a handler that requires the given basic auth
+// credentials, answering 401 otherwise.
+func basicAuth(next http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestUser, requestPassword, ok := r.BasicAuth()
+		// Compare both values so that a wrong user takes as long as a wrong password.
+		userMatches := subtle.ConstantTimeCompare([]byte(requestUser), []byte(user)) == 1
+		passwordMatches := subtle.ConstantTimeCompare([]byte(requestPassword), []byte(password)) == 1
+		if !ok || !userMatches || !passwordMatches {
+			w.Header().Set("WWW-Authenticate", `Basic realm="factorio-exporter", charset="UTF-8"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// readPasswordFile reads a password from a file, ignoring a trailing newline.
+func readPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("password file %s is empty", path)
+	}
+	return password, nil
+}
+
+// parseDisabledCollectors parses a comma-separated list of collector names.
+func parseDisabledCollectors(value string) (map[string]bool, error) {
+	known := map[string]bool{}
+	for _, name := range collector.CollectorNames() {
+		known[name] = true
+	}
+	disabled := map[string]bool{}
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !known[name] {
+			return nil, fmt.Errorf("unknown collector %q, valid names are %s", name, strings.Join(collector.CollectorNames(), ", "))
+		}
+		disabled[name] = true
+	}
+	return disabled, nil
+}
+
+// compileOptionalRegexp compiles pattern, returning nil for an empty pattern.
+func compileOptionalRegexp(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile(pattern)
+}
+
+// validateSources logs the sections found in the metrics data of every source
+// and warns about missing and unknown ones. It reports whether the data of all
+// sources could be parsed.
+func validateSources(sources []source, collectors []*collector.Collector) bool {
+	valid := true
+	for i, c := range collectors {
+		path := sources[i].path
+		validation, err := c.Validate()
+		if err != nil {
+			log.Error("Invalid metrics data", "path", path, "error", err)
+			valid = false
+			continue
+		}
+		log.Info("Found metrics data", "path", path, "sections", validation.Sections)
+		for _, section := range validation.Missing {
+			log.Warn("Missing section in metrics data", "path", path, "section", section)
+		}
+		for _, key := range validation.Unknown {
+			log.Warn("Unknown top-level key in metrics data", "path", path, "key", key)
+		}
+	}
+	return valid
+}
+
+// envPrefix is the prefix of the environment variables that set flags.
+const envPrefix = "FACTORIO_EXPORTER_"
+
+// applyEnvironment sets every flag of fs that was not given on the command line
+// from its environment variable, if present. The variable name is the flag name
+// in upper case with dashes replaced by underscores, prefixed with prefix.
+func applyEnvironment(fs *flag.FlagSet, prefix string) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		name := prefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+		}
+	})
+	return err
+}
+
+// applyConfigFile sets every flag of fs that was not given on the command line
+// or through the environment from the YAML file at path, which maps flag names
+// to values. A list sets a repeatable flag once per item.
+func applyConfigFile(fs *flag.FlagSet, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	var config map[string]yaml.Node
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	for name, node := range config {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown flag %q in config file", name)
+		}
+		if set[name] {
+			continue
+		}
+		values := []*yaml.Node{&node}
+		switch node.Kind {
+		case yaml.SequenceNode:
+			values = node.Content
+		case yaml.ScalarNode:
+		default:
+			return fmt.Errorf("invalid value for %s in config file, want a value or a list", name)
+		}
+		for _, value := range values {
+			if value.Kind != yaml.ScalarNode {
+				return fmt.Errorf("invalid value for %s in config file, want a value or a list", name)
+			}
+			if err := fs.Set(name, value.Value); err != nil {
+				return fmt.Errorf("invalid value %q for %s in config file: %w", value.Value, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+var configPath = flag.String("config", "", "The path to a YAML file setting flags by name, which the command line and environment take precedence over")
+var metricsPath = flag.String("path", "/factorio/script-output/metrics.json", "The path to the script-output/metrics.json file, which may be gzip-compressed, an http:// or https:// URL serving it, or an sse:// or sses:// URL of an event stream. Several sources can be given separated by commas, optionally as name=path, to add a server label")
+var maxReadBytes = flag.Int("max-read-bytes", 64<<20, "The maximum size of metrics data read from a remote source, an event stream or a FIFO such as /dev/stdin, after decompression")
+var readTimeout = flag.Duration("read-timeout", 5*time.Second, "The maximum time reading or fetching the metrics file may take (0 disables)")
+var serveLastData = flag.Bool("serve-last-data", false, "Collect the metrics from the last successfully parsed metrics data when the current data cannot be parsed, with factorio_up at 0 and factorio_metrics_data_stale at 1")
+var minReadInterval = flag.Duration("min-read-interval", 0, "Serve scrapes within this time of the last read from its result, so that concurrent scrapes do not wait for each other (0 reads on every scrape)")
+var namespace = flag.String("namespace", "factorio", "The prefix of all metric names")
+var metricsBind = flag.String("bind", "127.0.0.1:9102", "The hostname and port to listen on")
+var serverReadHeaderTimeout = flag.Duration("server-read-header-timeout", 10*time.Second, "The maximum time a client may take to send the request headers (0 disables)")
+var serverReadTimeout = flag.Duration("server-read-timeout", 30*time.Second, "The maximum time a client may take to send the whole request (0 disables)")
+var serverWriteTimeout = flag.Duration("server-write-timeout", time.Minute, "The maximum time from reading the request headers to sending the whole response, which includes collecting the metrics (0 disables)")
+var insecureListenRequired = flag.Bool("insecure-listen-required", false, "Refuse to start when listening on a non-loopback address without authentication")
+var authUser = flag.String("auth-user", "", "The user name required to access the metrics (requires -auth-password-file)")
+var authPasswordFile = flag.String("auth-password-file", "", "The path to a file containing the password required to access the metrics")
+var logFormat = flag.String("log-format", "text", "The log output format, text or json")
+var validate = flag.Bool("validate", false, "Check that the metrics data can be parsed, report its sections and exit, with a non-zero status if it cannot be parsed")
+var once = flag.Bool("once", false, "Print the metrics to stdout once and exit instead of serving them")
+var printVersion = flag.Bool("version", false, "Print the version and exit")
+var verbose = flag.Bool("verbose", false, "Enable verbose logging")
+var collectRecipes = flag.Bool("collect-recipes", false, "Collect the number of machines per recipe (high cardinality)")
+var trainNetworks = flag.Bool("collect-train-networks", false, "Add a rail network label to train counts")
+var logisticRequests = flag.Bool("collect-logistic-request-items", false, "Collect unfulfilled logistic requests per item (high cardinality)")
+var unpoweredEntities = flag.Bool("collect-unpowered-entities", false, "Collect the number of unpowered entities per prototype (high cardinality)")
+var surfaceClock = flag.Bool("collect-surface-clock", false, "Collect the time of day of each surface as an hh:mm label (a new series every game minute)")
+var playerInventory = flag.Bool("collect-player-inventory", false, "Collect the items in the main inventory of each player (high cardinality)")
+var openMetrics = flag.Bool("openmetrics", false, "Serve the OpenMetrics format to scrapers that accept it, and append _total to the names of counters without it in every format, as OpenMetrics requires (implied by -exemplars)")
+var exemplars = flag.Bool("exemplars", false, "Attach the current game tick as an exemplar to counters (OpenMetrics only)")
+var exitAfterStale = flag.Duration("exit-after-stale", 0, "Exit with an error if no scrape read new metrics data for this long, which includes not being scraped at all (0 disables)")
+var defaultForce = flag.String("default-force", "player", "The force label for entity counts that are not grouped by force, or empty for surface-wide counts")
+var surfaceInclude = flag.String("surface-include", "", "A regular expression; only collect metrics of the surfaces whose name it matches")
+var entityInclude = flag.String("entity-include", "", "A regular expression; only count entities whose prototype name it matches")
+var entityExclude = flag.String("entity-exclude", "", "A regular expression; do not count entities whose prototype name it matches")
+var entityAggregation = flag.String("entity-aggregation", "name", "Report entity counts per prototype name, or per prototype type with type (requires -metadata-path)")
+var entityQuality = flag.Bool("entity-quality", false, "Add a quality label to entity counts instead of summing qualities (higher cardinality)")
+var zeroNonFinite = flag.Bool("zero-non-finite", false, "Emit NaN and infinite values as 0 instead of dropping them")
+var normalizeLabels = flag.Bool("normalize-labels", false, "Lowercase and trim label values, summing series that become identical")
+var metadataPath = flag.String("metadata-path", "", "The path to an optional JSON file with static prototype metadata")
+var labelMapPath = flag.String("label-map", "", "The path to a JSON file mapping raw label values to display names, per label name")
+var disableCollectors = flag.String("disable-collectors", "", "A comma-separated list of collectors to skip, out of "+strings.Join(collector.CollectorNames(), ", "))
+var reportUnknownKeys = flag.Bool("report-unknown-keys", false, "Report top-level JSON keys that the exporter does not consume")
+
+func main() {
+	// Get the metrics path and port from the command line.
+	flag.Parse()
+	if *printVersion {
+		fmt.Printf("factorio-exporter %s (commit %s, %s)\n", version, commit, runtime.Version())
+		return
+	}
+	if err := applyEnvironment(flag.CommandLine, envPrefix); err != nil {
+		log.Error("Failed to apply environment", "error", err)
+		os.Exit(1)
+	}
+	if *configPath != "" {
+		if err := applyConfigFile(flag.CommandLine, *configPath); err != nil {
+			log.Error("Failed to apply config file", "error", err)
+			os.Exit(1)
+		}
+	}
+	// Keep stdout free for the metrics with -once.
+	logOutput := io.Writer(os.Stdout)
+	if *once {
+		logOutput = os.Stderr
+	}
+	logger, err := newLogger(logOutput, *logFormat)
+	if err != nil {
+		log.Error("Invalid log format", "error", err)
+		os.Exit(1)
+	}
+	log = logger
+	slog.SetDefault(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if *verbose {
+		logLevel.Set(slog.LevelDebug)
+	}
+
+	if (*authUser == "") != (*authPasswordFile == "") {
+		log.Error("Basic auth requires both -auth-user and -auth-password-file")
+		os.Exit(1)
+	}
+	authPassword := ""
+	if *authPasswordFile != "" {
+		password, err := readPasswordFile(*authPasswordFile)
+		if err != nil {
+			log.Error("Failed to load basic auth password", "error", err)
+			os.Exit(1)
+		}
+		authPassword = password
+	}
+
+	if *authUser == "" && !isLoopbackAddress(*metricsBind) {
+		if *insecureListenRequired {
+			log.Error("Refusing to listen on a non-loopback address without authentication", "interface", *metricsBind)
+			os.Exit(1)
+		}
+		log.Warn("Listening on a non-loopback address without authentication, metrics are exposed to the network", "interface", *metricsBind)
+	}
+
+	labels, err := collector.LoadLabelMap(*labelMapPath)
+	if err != nil {
+		log.Error("Failed to load label map", "error", err)
+		os.Exit(1)
+	}
+
+	if !namespacePattern.MatchString(*namespace) {
+		log.Error("Invalid metric namespace", "namespace", *namespace)
+		os.Exit(1)
+	}
+	if *maxReadBytes <= 0 {
+		log.Error("The maximum read size must be positive", "max_read_bytes", *maxReadBytes)
+		os.Exit(1)
+	}
+	if *serverWriteTimeout > 0 && *readTimeout > 0 && *serverWriteTimeout <= *readTimeout {
+		log.Warn("The server write timeout does not leave time to send the metrics after a slow read", "server_write_timeout", *serverWriteTimeout, "read_timeout", *readTimeout)
+	}
+	if *entityAggregation != "name" && *entityAggregation != "type" {
+		log.Error("The entity aggregation must be name or type", "entity_aggregation", *entityAggregation)
+		os.Exit(1)
+	}
+	if *entityAggregation == "type" && *metadataPath == "" {
+		log.Error("Aggregating entities by type requires -metadata-path")
+		os.Exit(1)
+	}
+	surfaceIncludePattern, err := compileOptionalRegexp(*surfaceInclude)
+	if err != nil {
+		log.Error("Invalid -surface-include", "error", err)
+		os.Exit(1)
+	}
+	entityIncludePattern, err := compileOptionalRegexp(*entityInclude)
+	if err != nil {
+		log.Error("Invalid -entity-include", "error", err)
+		os.Exit(1)
+	}
+	entityExcludePattern, err := compileOptionalRegexp(*entityExclude)
+	if err != nil {
+		log.Error("Invalid -entity-exclude", "error", err)
+		os.Exit(1)
+	}
+	disabledCollectors, err := parseDisabledCollectors(*disableCollectors)
+	if err != nil {
+		log.Error("Invalid -disable-collectors", "error", err)
+		os.Exit(1)
+	}
+	sources, err := parseSources(*metricsPath)
+	if err != nil {
+		log.Error("Invalid metrics path", "error", err)
+		os.Exit(1)
+	}
+	if _, ok := constLabels["server"]; ok && sources[0].name != "" {
+		log.Error("The server label is set both as a constant label and by the metrics sources")
+		os.Exit(1)
+	}
+
+	// With -once, only the exporter's own metrics are gathered, without the
+	// Go runtime and process metrics of the default registry.
+	var registerer prometheus.Registerer = prometheus.DefaultRegisterer
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *once {
+		registry := prometheus.NewRegistry()
+		registerer, gatherer = registry, registry
+	}
+
+	var collectors []*collector.Collector
+	for _, src := range sources {
+		// Create a collector for every source, so that each one is read and
+		// cached on its own.
+		c := collector.NewFactorioCollector(src.path)
+		c.MaxReadBytes = *maxReadBytes
+		c.ReadTimeout = *readTimeout
+		c.MinReadInterval = *minReadInterval
+		c.ServeLastData = *serveLastData
+		c.ReportUnknownKeys = *reportUnknownKeys
+		c.CollectRecipes = *collectRecipes
+		c.UnpoweredEntities = *unpoweredEntities
+		c.LogisticRequests = *logisticRequests
+		c.TrainNetworks = *trainNetworks
+		c.PlayerInventory = *playerInventory
+		c.SurfaceClock = *surfaceClock
+		c.EntityQuality = *entityQuality
+		c.EntityAggregation = *entityAggregation
+		c.SurfaceInclude = surfaceIncludePattern
+		c.EntityInclude = entityIncludePattern
+		c.EntityExclude = entityExcludePattern
+		c.DefaultForce = *defaultForce
+		c.MetadataPath = *metadataPath
+		c.DisabledCollectors = disabledCollectors
+		c.Namespace = *namespace
+		c.Exemplars = *exemplars
+		c.TotalSuffix = *openMetrics || *exemplars
+		c.ZeroNonFinite = *zeroNonFinite
+		c.LabelMap = labels
+		c.NormalizeLabels = *normalizeLabels
+		c.StaleTimeout = *exitAfterStale
+		c.OnStale = func() {
+			log.Error("No successful read of the metrics data, exiting", "path", src.path, "timeout", *exitAfterStale)
+			os.Exit(1)
+		}
+		c.Start(ctx)
+		if *validate {
+			// Registering collects once, which would read the data twice.
+			collectors = append(collectors, c)
+			continue
+		}
+
+		// Register the collector with Prometheus.
+		src.register(registerer, c, prometheus.Labels(constLabels))
+		collectors = append(collectors, c)
+	}
+
+	prometheus.WrapRegistererWith(prometheus.Labels(constLabels), registerer).MustRegister(newBuildInfo(*namespace))
+
+	if *once || *validate {
+		// Event streams connect in the background, so give them up to the
+		// read timeout to deliver their first event before the single read.
+		waitCtx, cancel := ctx, context.CancelFunc(func() {})
+		if *readTimeout > 0 {
+			waitCtx, cancel = context.WithTimeout(ctx, *readTimeout)
+		}
+		for i, c := range collectors {
+			if err := c.WaitReady(waitCtx); err != nil {
+				log.Warn("Event stream did not deliver any data in time", "path", sources[i].path, "timeout", *readTimeout)
+			}
+		}
+		cancel()
+	}
+	if *once {
+		if err := writeMetrics(os.Stdout, gatherer); err != nil {
+			log.Error("Failed to write metrics", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *validate {
+		if !validateSources(sources, collectors) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Start the HTTP server.
+	log.Info("Starting Prometheus exporter", "interface", *metricsBind)
+	pages := http.NewServeMux()
+	pages.Handle("/metrics", metricsHandler(registerer, gatherer, *openMetrics || *exemplars))
+	pages.Handle("/", landingPage())
+	var protected http.Handler = pages
+	if *authUser != "" {
+		protected = basicAuth(pages, *authUser, authPassword)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/health", healthHandler(collectors))
+	mux.Handle("/", protected)
+	server := &http.Server{
+		Addr:              *metricsBind,
+		Handler:           mux,
+		ReadHeaderTimeout: *serverReadHeaderTimeout,
+		ReadTimeout:       *serverReadTimeout,
+		WriteTimeout:      *serverWriteTimeout,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		log.Error("Failed to serve", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+
+	// Let in-flight scrapes finish before exiting.
+	log.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Error("Failed to shut down gracefully", "error", err)
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/max-te/factorio-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestApplyEnvironment(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	path := fs.String("path", "default.json", "")
+	bind := fs.String("bind", "127.0.0.1:9102", "")
+	verbose := fs.Bool("verbose", false, "")
+	exitAfterStale := fs.Duration("exit-after-stale", 0, "")
+	if err := fs.Parse([]string{"-bind", ":9200"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("TEST_PATH", "env.json")
+	t.Setenv("TEST_BIND", ":9300")
+	t.Setenv("TEST_EXIT_AFTER_STALE", "5m")
+
+	if err := applyEnvironment(fs, "TEST_"); err != nil {
+		t.Fatal(err)
+	}
+	if *path != "env.json" {
+		t.Errorf("path: got %q, want the environment value", *path)
+	}
+	if *bind != ":9200" {
+		t.Errorf("bind: got %q, want the command-line value", *bind)
+	}
+	if *verbose {
+		t.Error("verbose: got true, want the default")
+	}
+	if *exitAfterStale != 5*time.Minute {
+		t.Errorf("exit-after-stale: got %v, want 5m", *exitAfterStale)
+	}
+
+	t.Setenv("TEST_VERBOSE", "maybe")
+	if err := applyEnvironment(fs, "TEST_"); err == nil {
+		t.Error("expected an error for an invalid boolean")
+	}
+}
+
+func TestLabelsFlag(t *testing.T) {
+	labels := labelsFlag{}
+	if err := labels.Set("cluster=eu"); err != nil {
+		t.Errorf("cluster=eu: %v", err)
+	}
+	for _, value := range []string{"cluster", "__name__=x", "1abc=x", "empty=", "force=prod", "surface=nauvis", "version=1", "commit=abc"} {
+		if err := labels.Set(value); err == nil {
+			t.Errorf("%s: got no error", value)
+		}
+	}
+	if len(labels) != 1 {
+		t.Errorf("got labels %v, want only cluster", labels)
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	path := fs.String("path", "default.json", "")
+	bind := fs.String("bind", "127.0.0.1:9102", "")
+	maxReadBytes := fs.Int("max-read-bytes", 64<<20, "")
+	labels := labelsFlag{}
+	fs.Var(labels, "const-labels", "")
+	if err := fs.Parse([]string{"-bind", ":9200"}); err != nil {
+		t.Fatal(err)
+	}
+
+	config := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(config, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`
+path: alpha=/srv/alpha/metrics.json,beta=/srv/beta/metrics.json
+bind: ":9300"
+max-read-bytes: 1048576
+const-labels:
+  - cluster=eu
+  - env=prod
+`)
+	if err := applyConfigFile(fs, config); err != nil {
+		t.Fatal(err)
+	}
+	if *path != "alpha=/srv/alpha/metrics.json,beta=/srv/beta/metrics.json" {
+		t.Errorf("path: got %q, want the config file value", *path)
+	}
+	if *bind != ":9200" {
+		t.Errorf("bind: got %q, want the command-line value", *bind)
+	}
+	if *maxReadBytes != 1<<20 {
+		t.Errorf("max-read-bytes: got %d, want 1048576", *maxReadBytes)
+	}
+	if labels["cluster"] != "eu" || labels["env"] != "prod" {
+		t.Errorf("const-labels: got %v, want cluster and env", labels)
+	}
+
+	for _, content := range []string{"unknown-flag: 1", "config: other.yaml", "max-read-bytes: lots", "path: {a: b}"} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("config", "", "")
+		fs.String("path", "default.json", "")
+		fs.Int("max-read-bytes", 64<<20, "")
+		write(content)
+		if err := applyConfigFile(fs, config); err == nil {
+			t.Errorf("%s: got no error", content)
+		}
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	handler := basicAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "metrics")
+	}), "prometheus", "secret")
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		noAuth   bool
+		expected int
+	}{
+		{name: "valid", user: "prometheus", password: "secret", expected: http.StatusOK},
+		{name: "wrong password", user: "prometheus", password: "guess", expected: http.StatusUnauthorized},
+		{name: "wrong user", user: "admin", password: "secret", expected: http.StatusUnauthorized},
+		{name: "no credentials", noAuth: true, expected: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if !tt.noAuth {
+				request.SetBasicAuth(tt.user, tt.password)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != tt.expected {
+				t.Errorf("got status %d, want %d", recorder.Code, tt.expected)
+			}
+			if tt.expected == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestIsLoopbackAddress(t *testing.T) {
+	tests := []struct {
+		address  string
+		expected bool
+	}{
+		{":9102", false},
+		{"0.0.0.0:9102", false},
+		{"[::]:9102", false},
+		{"192.168.1.10:9102", false},
+		{"factorio.example.com:9102", false},
+		{"127.0.0.1:9102", true},
+		{"[::1]:9102", true},
+		{"localhost:9102", true},
+		{"localhost", false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackAddress(tt.address); got != tt.expected {
+			t.Errorf("%q: got %v, want %v", tt.address, got, tt.expected)
+		}
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := os.WriteFile(path, []byte(`{"game": {}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	handler := healthHandler([]*collector.Collector{collector.NewFactorioCollector(path)})
+
+	status := func() int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+		return recorder.Code
+	}
+
+	if got := status(); got != http.StatusOK {
+		t.Errorf("got status %d for a valid file, want %d", got, http.StatusOK)
+	}
+	if err := os.WriteFile(path, []byte(`{"game": `), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for an invalid file, want %d", got, http.StatusServiceUnavailable)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for a missing file, want %d", got, http.StatusServiceUnavailable)
+	}
+}
+
+func TestLandingPage(t *testing.T) {
+	handler := landingPage()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("got status %d for /, want %d", recorder.Code, http.StatusOK)
+	}
+	if !strings.Contains(recorder.Body.String(), `href="/metrics"`) {
+		t.Errorf("landing page does not link to /metrics: %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("got status %d for /unknown, want %d", recorder.Code, http.StatusNotFound)
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := os.WriteFile(path, []byte(`{"game": {"time": {"tick": 42}}, "forces": {"player": {
+		"pollution_produced": 52, "rockets": {"launches": 2}, "items": {"nauvis": {"iron-plate": {"production": 7}}}
+	}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	c := collector.NewFactorioCollector(path)
+	c.Exemplars = true
+	c.TotalSuffix = true
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(c)
+
+	const accept = "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5"
+	tests := []struct {
+		openMetrics bool
+		contentType string
+		eof         bool
+	}{
+		{openMetrics: false, contentType: "text/plain"},
+		{openMetrics: true, contentType: "application/openmetrics-text", eof: true},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.openMetrics), func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			request.Header.Set("Accept", accept)
+			recorder := httptest.NewRecorder()
+			metricsHandler(prometheus.NewRegistry(), registry, tt.openMetrics).ServeHTTP(recorder, request)
+
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body.String())
+			}
+			if got := recorder.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("got content type %q, want %s", got, tt.contentType)
+			}
+			body := recorder.Body.String()
+			if eof := strings.HasSuffix(body, "# EOF\n"); eof != tt.eof {
+				t.Errorf("got # EOF %v, want %v:\n%s", eof, tt.eof, body)
+			}
+			if !tt.openMetrics {
+				return
+			}
+			for _, sample := range []string{
+				`factorio_force_pollution_produced_total{force="player"} 52.0 # {tick="42"} 52.0`,
+				`factorio_force_prototype_production_total{force="player",prototype="iron-plate",surface="nauvis",type="items"} 7.0 # {tick="42"} 7.0`,
+				`factorio_rockets_launched_total{force="player"} 2.0 # {tick="42"} 2.0`,
+			} {
+				if !strings.Contains(body, sample) {
+					t.Errorf("missing %s:\n%s", sample, body)
+				}
+			}
+			if strings.Contains(body, " unknown\n") {
+				t.Errorf("got a metric of unknown type:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestParseDisabledCollectors(t *testing.T) {
+	disabled, err := parseDisabledCollectors("entities, pollution,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(disabled) != 2 || !disabled["entities"] || !disabled["pollution"] {
+		t.Errorf("got disabled collectors %v, want entities and pollution", disabled)
+	}
+
+	if _, err := parseDisabledCollectors("entities,power"); err == nil {
+		t.Error("got no error for an unknown collector")
+	}
+}
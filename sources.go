@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/max-te/factorio-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// source is a metrics file or event stream along with the server label of its
+// metrics. An empty name means that no server label is added.
+type source struct {
+	name string
+	path string
+}
+
+// sourceNamePattern matches explicit source names in the name=path syntax.
+// URLs and most paths contain characters outside of it, so a "=" in them is
+// not mistaken for a name.
+var sourceNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// parseSources parses a comma-separated list of sources, each either a path or
+// name=path. A single source without a name gets no server label. With
+// several sources, unnamed ones are named after their file name without the
+// extension, or the host of a URL, and names must be unique.
+func parseSources(value string) ([]source, error) {
+	var sources []source
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var s source
+		if name, path, ok := strings.Cut(entry, "="); ok && sourceNamePattern.MatchString(name) {
+			s = source{name: name, path: path}
+		} else {
+			s = source{path: entry}
+		}
+		if s.path == "" {
+			return nil, fmt.Errorf("source %q has no path", entry)
+		}
+		sources = append(sources, s)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no source given")
+	}
+	if len(sources) == 1 {
+		return sources, nil
+	}
+
+	names := make(map[string]string, len(sources))
+	for i := range sources {
+		if sources[i].name == "" {
+			sources[i].name = sourceName(sources[i].path)
+		}
+		if other, ok := names[sources[i].name]; ok {
+			return nil, fmt.Errorf("sources %q and %q are both named %q, use name=path to tell them apart", other, sources[i].path, sources[i].name)
+		}
+		names[sources[i].name] = sources[i].path
+	}
+	return sources, nil
+}
+
+// register registers the collector of the source, adding constLabels and the
+// server label to its metrics. The label only depends on the source, so every
+// read and collection reports it the same way.
+func (s source) register(registerer prometheus.Registerer, c prometheus.Collector, constLabels prometheus.Labels) {
+	labels := prometheus.Labels{}
+	for name, value := range constLabels {
+		labels[name] = value
+	}
+	if s.name != "" {
+		labels["server"] = s.name
+	}
+	prometheus.WrapRegistererWith(labels, registerer).MustRegister(c)
+}
+
+// sourceName derives the server label of an unnamed source.
+func sourceName(path string) string {
+	if collector.IsSSESource(path) || collector.IsHTTPSource(path) {
+		if u, err := url.Parse(path); err == nil && u.Host != "" {
+			return u.Host
+		}
+		return path
+	}
+	base := filepath.Base(path)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
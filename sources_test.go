@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/max-te/factorio-exporter/collector"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseSources(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected []source
+		wantErr  bool
+	}{
+		{
+			value:    "/factorio/script-output/metrics.json",
+			expected: []source{{path: "/factorio/script-output/metrics.json"}},
+		},
+		{
+			value:    "main=/factorio/script-output/metrics.json",
+			expected: []source{{name: "main", path: "/factorio/script-output/metrics.json"}},
+		},
+		{
+			value: "/srv/alpha.json, beta=/srv/b/metrics.json,sse://gamma:8080/events?format=json",
+			expected: []source{
+				{name: "alpha", path: "/srv/alpha.json"},
+				{name: "beta", path: "/srv/b/metrics.json"},
+				{name: "gamma:8080", path: "sse://gamma:8080/events?format=json"},
+			},
+		},
+		{
+			value: "http://alpha:8080/metrics.json,https://beta/metrics.json",
+			expected: []source{
+				{name: "alpha:8080", path: "http://alpha:8080/metrics.json"},
+				{name: "beta", path: "https://beta/metrics.json"},
+			},
+		},
+		{
+			value:   "/srv/a/metrics.json,/srv/b/metrics.json",
+			wantErr: true,
+		},
+		{
+			value:   "a=",
+			wantErr: true,
+		},
+		{
+			value:   " , ",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			sources, err := parseSources(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got sources %v, want an error", sources)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(sources, tt.expected) {
+				t.Errorf("got sources %v, want %v", sources, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSourceServerLabels(t *testing.T) {
+	dir := t.TempDir()
+	writeTicks := func(ticks map[string]int) {
+		for name, tick := range ticks {
+			data := fmt.Sprintf(`{"game": {"time": {"tick": %d}}}`, tick)
+			if err := os.WriteFile(filepath.Join(dir, name+".json"), []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	alpha, beta := filepath.Join(dir, "alpha.json"), filepath.Join(dir, "beta.json")
+
+	// The order of the sources and the reads must not change which server
+	// label the metrics of a file are reported under.
+	for _, value := range []string{alpha + "," + beta, beta + "," + alpha, "b=" + beta + ",a=" + alpha} {
+		t.Run(value, func(t *testing.T) {
+			sources, err := parseSources(value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			registry := prometheus.NewRegistry()
+			servers := make(map[string]string)
+			for _, src := range sources {
+				src.register(registry, collector.NewFactorioCollector(src.path), prometheus.Labels{"cluster": "eu"})
+				servers[strings.TrimSuffix(filepath.Base(src.path), ".json")] = src.name
+			}
+
+			// Every write changes the size of the files, so that they are
+			// read again even if the modification time stays the same.
+			for i, tick := range []int{1, 10, 100} {
+				writeTicks(map[string]int{"alpha": tick, "beta": 2 * tick})
+				expected := fmt.Sprintf(`
+# HELP factorio_game_tick The current tick of the running Factorio game (ticks).
+# TYPE factorio_game_tick counter
+factorio_game_tick{cluster="eu",server=%q} %d
+factorio_game_tick{cluster="eu",server=%q} %d
+`, servers["alpha"], tick, servers["beta"], 2*tick)
+				if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "factorio_game_tick"); err != nil {
+					t.Errorf("read %d: %v", i, err)
+				}
+			}
+		})
+	}
+}